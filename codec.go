@@ -0,0 +1,250 @@
+package log
+
+import (
+	"encoding/binary"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"google.golang.org/protobuf/proto"
+	"sort"
+)
+
+const (
+	// CodecProto is the ID of ProtoCodec. It is zero, so the store files written before the header recorded the codec
+	// are decoded with it.
+	CodecProto uint8 = iota
+	// CodecRaw is the ID of RawCodec.
+	CodecRaw
+)
+
+// The flags of RawCodec tell which of the optional fields of the record are encoded.
+const (
+	rawKey byte = 1 << iota
+	rawTimestamp
+	rawHeaders
+	rawType
+
+	rawFlags = rawKey | rawTimestamp | rawHeaders | rawType
+)
+
+// Codec encodes the records into the payloads of the store frames. The codec of a segment is recorded in the header
+// of its store file, so the segments of a log written with another codec stay readable.
+type Codec interface {
+	// ID identifies the codec in the header of the store files. The IDs below 128 are reserved for the codecs of this
+	// package.
+	ID() uint8
+	// Encode appends the encoding of record to dst and returns the extended buffer.
+	Encode(dst []byte, record *log_v1.Record) ([]byte, error)
+	// Decode decodes data into record. data may be a slice into the mapping of a store file, so record must not
+	// retain it.
+	Decode(data []byte, record *log_v1.Record) error
+	// Value returns the value of the encoded record data as a slice of data, without decoding the whole record.
+	Value(data []byte) ([]byte, error)
+}
+
+// offsetCodec is implemented by the codecs which read the offset of an encoded record without decoding the whole
+// record. The offset is decoded by Codec.Decode for the other codecs.
+type offsetCodec interface {
+	// Offset returns the offset of the encoded record data.
+	Offset(data []byte) (uint64, error)
+}
+
+// ProtoCodec encodes the records as protocol buffers messages. It is the default codec.
+type ProtoCodec struct{}
+
+func (ProtoCodec) ID() uint8 {
+	return CodecProto
+}
+
+func (ProtoCodec) Encode(dst []byte, record *log_v1.Record) ([]byte, error) {
+	return proto.MarshalOptions{}.MarshalAppend(dst, record)
+}
+
+func (ProtoCodec) Decode(data []byte, record *log_v1.Record) error {
+	return proto.Unmarshal(data, record)
+}
+
+func (ProtoCodec) Value(data []byte) ([]byte, error) {
+	return recordValue(data)
+}
+
+func (ProtoCodec) Offset(data []byte) (uint64, error) {
+	return recordOffset(data)
+}
+
+// RawCodec encodes a record as its offset as a varint, a flags byte, the optional fields set in the flags and the
+// value. It saves the field tags and the length of the value of ProtoCodec.
+type RawCodec struct{}
+
+func (RawCodec) ID() uint8 {
+	return CodecRaw
+}
+
+func (RawCodec) Encode(dst []byte, record *log_v1.Record) ([]byte, error) {
+	flags := byte(0)
+	if len(record.Key) > 0 {
+		flags |= rawKey
+	}
+	if record.Timestamp != 0 {
+		flags |= rawTimestamp
+	}
+	if len(record.Headers) > 0 {
+		flags |= rawHeaders
+	}
+	if record.Type != "" {
+		flags |= rawType
+	}
+
+	dst = binary.AppendUvarint(dst, record.Offset)
+	dst = append(dst, flags)
+	if flags&rawKey != 0 {
+		dst = appendRawBytes(dst, record.Key)
+	}
+	if flags&rawTimestamp != 0 {
+		dst = binary.AppendVarint(dst, record.Timestamp)
+	}
+	if flags&rawHeaders != 0 {
+		// the headers are sorted, so a record is always encoded the same.
+		keys := make([]string, 0, len(record.Headers))
+		for key := range record.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		dst = binary.AppendUvarint(dst, uint64(len(keys)))
+		for _, key := range keys {
+			dst = appendRawBytes(dst, []byte(key))
+			dst = appendRawBytes(dst, record.Headers[key])
+		}
+	}
+	if flags&rawType != 0 {
+		dst = appendRawBytes(dst, []byte(record.Type))
+	}
+	return append(dst, record.Value...), nil
+}
+
+func (c RawCodec) Decode(data []byte, record *log_v1.Record) error {
+	record.Reset()
+	value, err := c.decode(data, record)
+	if err != nil {
+		return err
+	}
+	record.Value = append([]byte(nil), value...)
+	return nil
+}
+
+func (c RawCodec) Value(data []byte) ([]byte, error) {
+	return c.decode(data, nil)
+}
+
+func (RawCodec) Offset(data []byte) (uint64, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, ErrCorruptRecord
+	}
+	return offset, nil
+}
+
+// decode decodes the offset and the optional fields of the encoded record data into record, and returns the value.
+// The fields are only skipped if record is nil.
+func (RawCodec) decode(data []byte, record *log_v1.Record) ([]byte, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 || len(data) == n || data[n]&^rawFlags != 0 {
+		return nil, ErrCorruptRecord
+	}
+	flags := data[n]
+	data = data[n+1:]
+
+	var key, typ []byte
+	var timestamp int64
+	var headers map[string][]byte
+	var err error
+	if flags&rawKey != 0 {
+		if key, data, err = readRawBytes(data); err != nil {
+			return nil, err
+		}
+	}
+	if flags&rawTimestamp != 0 {
+		if timestamp, n = binary.Varint(data); n <= 0 {
+			return nil, ErrCorruptRecord
+		}
+		data = data[n:]
+	}
+	if flags&rawHeaders != 0 {
+		count, n := binary.Uvarint(data)
+		if n <= 0 || count > uint64(len(data)) {
+			return nil, ErrCorruptRecord
+		}
+		data = data[n:]
+		if record != nil {
+			headers = make(map[string][]byte, count)
+		}
+		for i := uint64(0); i < count; i++ {
+			var key, value []byte
+			if key, data, err = readRawBytes(data); err != nil {
+				return nil, err
+			}
+			if value, data, err = readRawBytes(data); err != nil {
+				return nil, err
+			}
+			if headers != nil {
+				headers[string(key)] = append([]byte(nil), value...)
+			}
+		}
+	}
+	if flags&rawType != 0 {
+		if typ, data, err = readRawBytes(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if record != nil {
+		record.Offset = offset
+		if key != nil {
+			record.Key = append([]byte(nil), key...)
+		}
+		record.Timestamp = timestamp
+		record.Headers = headers
+		record.Type = string(typ)
+	}
+	return data, nil
+}
+
+// appendRawBytes appends b to dst prefixed with its length as a varint.
+func appendRawBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// readRawBytes reads the bytes prefixed with their length as a varint from data, and returns them and the rest of
+// data.
+func readRawBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, ErrCorruptRecord
+	}
+	data = data[n:]
+	return data[:size], data[size:], nil
+}
+
+// codecs are the codecs of this package by ID.
+var codecs = map[uint8]Codec{
+	CodecProto: ProtoCodec{},
+	CodecRaw:   RawCodec{},
+}
+
+// codec returns the codec configured for the new segments.
+func (c Config) codec() Codec {
+	if c.Codec == nil {
+		return ProtoCodec{}
+	}
+	return c.Codec
+}
+
+// codecByID returns the codec with the given ID, which is the configured codec or one of the codecs of this package.
+func (c Config) codecByID(id uint8) (Codec, error) {
+	if codec := c.codec(); codec.ID() == id {
+		return codec, nil
+	}
+	if codec, ok := codecs[id]; ok {
+		return codec, nil
+	}
+	return nil, ErrUnknownCodec
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	for _, codec := range []Codec{ProtoCodec{}, RawCodec{}} {
+		record := &log_v1.Record{Value: []byte("hello, world"), Offset: 42}
+		data, err := codec.Encode([]byte("prefix"), record)
+		require.NoError(t, err)
+		require.Equal(t, "prefix", string(data[:6]))
+		data = data[6:]
+
+		decoded := new(log_v1.Record)
+		require.NoError(t, codec.Decode(data, decoded))
+		require.Equal(t, record.Value, decoded.Value)
+		require.Equal(t, record.Offset, decoded.Offset)
+		value, err := codec.Value(data)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, value)
+		offset, err := codec.(offsetCodec).Offset(data)
+		require.NoError(t, err)
+		require.Equal(t, record.Offset, offset)
+
+		// the decoded record does not alias the encoded data
+		data[len(data)-1] = 'D'
+		require.Equal(t, "hello, world", string(decoded.Value))
+	}
+
+	data, err := RawCodec{}.Encode(nil, &log_v1.Record{Offset: 1})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	_, err = RawCodec{}.Value(data[:1])
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	data[1] = 0xff
+	require.ErrorIs(t, RawCodec{}.Decode(data, new(log_v1.Record)), ErrCorruptRecord)
+}
+
+func TestCodecRecordFields(t *testing.T) {
+	for _, codec := range []Codec{ProtoCodec{}, RawCodec{}} {
+		record := &log_v1.Record{
+			Value:     []byte("hello, world"),
+			Offset:    42,
+			Key:       []byte("user-1"),
+			Timestamp: -1,
+			Headers:   map[string][]byte{"b": []byte("2"), "a": []byte("1"), "empty": {}},
+			Type:      "greeting",
+		}
+		data, err := codec.Encode(nil, record)
+		require.NoError(t, err)
+
+		decoded := new(log_v1.Record)
+		require.NoError(t, codec.Decode(data, decoded))
+		require.True(t, proto.Equal(record, decoded), "%v != %v", record, decoded)
+		value, err := codec.Value(data)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, value)
+		offset, err := codec.(offsetCodec).Offset(data)
+		require.NoError(t, err)
+		require.Equal(t, record.Offset, offset)
+
+		// a record without the optional fields does not keep the fields of the decoded record
+		data, err = codec.Encode(nil, &log_v1.Record{Value: []byte("plain"), Offset: 43})
+		require.NoError(t, err)
+		require.NoError(t, codec.Decode(data, decoded))
+		require.True(t, proto.Equal(&log_v1.Record{Value: []byte("plain"), Offset: 43}, decoded))
+	}
+
+	data, err := RawCodec{}.Encode(nil, &log_v1.Record{Key: []byte("key"), Type: "type"})
+	require.NoError(t, err)
+	for i := 2; i < len(data)-1; i++ {
+		err := RawCodec{}.Decode(data[:i], new(log_v1.Record))
+		require.ErrorIs(t, err, ErrCorruptRecord, "truncated at %d", i)
+	}
+}
+
+// upperCodec is a codec which is not part of the package. It stores the values in upper case.
+type upperCodec struct {
+	RawCodec
+}
+
+func (upperCodec) ID() uint8 {
+	return 200
+}
+
+func (c upperCodec) Encode(dst []byte, record *log_v1.Record) ([]byte, error) {
+	upper := make([]byte, len(record.Value))
+	for i, b := range record.Value {
+		if b >= 'a' && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		upper[i] = b
+	}
+	return c.RawCodec.Encode(dst, &log_v1.Record{Value: upper, Offset: record.Offset})
+}
+
+func TestLogCodec(t *testing.T) {
+	dir, err := os.MkdirTemp("", "codec-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 1024,
+			MaxIndexSize:   1024,
+		},
+	}
+	codecs := []Codec{RawCodec{}, ProtoCodec{}, upperCodec{}}
+	for i, codec := range codecs {
+		config.Codec = codec
+		log, err := NewLog(dir, config)
+		require.NoError(t, err)
+		require.Equal(t, i+1, len(log.segments), "a segment of another codec is followed by a new one")
+		require.Equal(t, codec.ID(), log.activeSegment.codec.ID())
+		require.Equal(t, codec.ID(), log.activeSegment.store.codec)
+		_, err = log.Append([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, log.Close())
+	}
+
+	config.Codec = upperCodec{}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Equal(t, 3, len(log.segments))
+	require.Less(t, log.segments[0].Size(), log.segments[1].Size(), "raw records are smaller than protobuf ones")
+
+	want := []string{"hello", "hello", "HELLO"}
+	for i, value := range want {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, value, string(data))
+		require.NoError(t, log.View(uint64(i), func(data []byte) error {
+			require.Equal(t, value, string(data))
+			return nil
+		}))
+	}
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	defer r.Close()
+	for i, value := range want {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, value, string(record.Value))
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestUnknownCodec(t *testing.T) {
+	dir, err := os.MkdirTemp("", "codec-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.Codec = upperCodec{}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	_, err = log.Append([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// the codec of the segment is not configured
+	_, err = NewLog(dir, defaultConfig)
+	require.ErrorIs(t, err, ErrUnknownCodec)
+}
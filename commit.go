@@ -0,0 +1,130 @@
+package log
+
+import (
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"time"
+)
+
+// appendRequest is an append queued for group commit.
+type appendRequest struct {
+	record *log_v1.Record
+	done   chan appendResult
+}
+
+type appendResult struct {
+	offset uint64
+	err    error
+}
+
+// enqueue queues record for group commit and waits until it is durable.
+func (l *Log) enqueue(record *log_v1.Record) (uint64, error) {
+	req := &appendRequest{
+		record: record,
+		done:   make(chan appendResult, 1),
+	}
+	l.closeMu.RLock()
+	if l.closed {
+		l.closeMu.RUnlock()
+		return 0, ErrLogClosed
+	}
+	l.appends <- req
+	l.closeMu.RUnlock()
+
+	res := <-req.done
+	return res.offset, res.err
+}
+
+// commitLoop collects the queued appends into batches and commits them until the queue is closed.
+func (l *Log) commitLoop() {
+	defer l.wg.Done()
+
+	for {
+		req, ok := <-l.appends
+		if !ok {
+			return
+		}
+		batch := []*appendRequest{req}
+
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if l.Config.GroupCommit.MaxWait > 0 {
+			timer = time.NewTimer(l.Config.GroupCommit.MaxWait)
+			wait = timer.C
+		}
+		batch = l.collect(batch, wait)
+		if timer != nil {
+			timer.Stop()
+		}
+		l.commit(batch)
+	}
+}
+
+// collect adds queued appends to batch until it is full or wait fires. It only takes the appends already queued if
+// wait is nil.
+func (l *Log) collect(batch []*appendRequest, wait <-chan time.Time) []*appendRequest {
+	for len(batch) < l.Config.GroupCommit.MaxBatchSize {
+		if wait == nil {
+			select {
+			case req, ok := <-l.appends:
+				if !ok {
+					return batch
+				}
+				batch = append(batch, req)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case req, ok := <-l.appends:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, req)
+		case <-wait:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit writes the batch and makes it durable with one sync of every segment it touched, then releases the callers.
+// The records are written with one write per segment, but every record gets a frame of its own, so the appends stay
+// independent: an append which fails does not fail the others. The batch is only synced if the sync policy is
+// SyncAlways.
+func (l *Log) commit(batch []*appendRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := make([]*log_v1.Record, len(batch))
+	for i, req := range batch {
+		records[i] = req.record
+	}
+	results := make([]appendResult, len(batch))
+	segments := make([]*Segment, 0, 1)
+	for i := 0; i < len(records); {
+		first, n, seg, err := l.appendFrames(records[i:])
+		if err != nil {
+			results[i] = appendResult{err: err}
+			i++
+			continue
+		}
+		for j := 0; j < n; j++ {
+			results[i+j] = appendResult{offset: first + uint64(j)}
+		}
+		if len(segments) == 0 || segments[len(segments)-1] != seg {
+			segments = append(segments, seg)
+		}
+		i += n
+	}
+	if err := l.commitSegments(segments...); err != nil {
+		for i := range results {
+			if results[i].err == nil {
+				results[i] = appendResult{err: err}
+			}
+		}
+	}
+	for i, req := range batch {
+		req.done <- results[i]
+	}
+}
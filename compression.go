@@ -0,0 +1,153 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm the records are compressed with in the store files. It is recorded in the attributes
+// of every frame, so the segments written with another compression, or without any, stay readable.
+type Compression uint8
+
+const (
+	// CompressionNone writes a frame per record. It is the default.
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+	CompressionGzip
+
+	compressionCount
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCoders returns the zstd encoder and decoder shared by the logs. Their EncodeAll and DecodeAll methods are safe
+// for concurrent use.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// The options are valid, so there is no error.
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// valid reports whether c is one of the compressions of this package.
+func (c Compression) valid() bool {
+	return c < compressionCount
+}
+
+// compress appends src compressed with c to dst.
+func (c Compression) compress(dst []byte, src []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return append(dst, snappy.Encode(nil, src)...), nil
+	case CompressionZstd:
+		encoder, _ := zstdCoders()
+		return encoder.EncodeAll(src, dst), nil
+	case CompressionGzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+// decompress returns src decompressed with c. Data which does not decompress is reported as ErrCorruptRecord.
+func (c Compression) decompress(src []byte) ([]byte, error) {
+	var data []byte
+	var err error
+	switch c {
+	case CompressionSnappy:
+		data, err = snappy.Decode(nil, src)
+	case CompressionZstd:
+		_, decoder := zstdCoders()
+		data, err = decoder.DecodeAll(src, nil)
+	case CompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(src)); err == nil {
+			data, err = io.ReadAll(r)
+		}
+	default:
+		return nil, ErrUnknownCompression
+	}
+	if err != nil {
+		return nil, ErrCorruptRecord
+	}
+	return data, nil
+}
+
+// encodeBatch returns the payload of a frame carrying the encoded records from offset first compressed with c. The
+// payload is the offset of the first record and the number of records as varints, followed by the compressed records,
+// each prefixed with its length as a varint.
+func (c Compression) encodeBatch(first uint64, records [][]byte) ([]byte, error) {
+	size := 0
+	for _, record := range records {
+		size += binary.MaxVarintLen64 + len(record)
+	}
+	body := make([]byte, 0, size)
+	for _, record := range records {
+		body = appendRawBytes(body, record)
+	}
+	data := binary.AppendUvarint(nil, first)
+	data = binary.AppendUvarint(data, uint64(len(records)))
+	return c.compress(data, body)
+}
+
+// decodeBatch returns the offset of the first record and the encoded records of the payload of a frame compressed with
+// c.
+func (c Compression) decodeBatch(data []byte) (uint64, [][]byte, error) {
+	first, count, body, err := batchHeader(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body, err = c.decompress(body); err != nil {
+		return 0, nil, err
+	}
+	if count > uint64(len(body)) {
+		return 0, nil, ErrCorruptRecord
+	}
+	records := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var record []byte
+		if record, body, err = readRawBytes(body); err != nil {
+			return 0, nil, err
+		}
+		records = append(records, record)
+	}
+	if len(body) > 0 {
+		return 0, nil, ErrCorruptRecord
+	}
+	return first, records, nil
+}
+
+// batchHeader returns the offset of the first record, the number of records and the compressed records of the payload
+// of a compressed frame, without decompressing it.
+func batchHeader(data []byte) (first uint64, count uint64, body []byte, err error) {
+	first, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	data = data[n:]
+	count, n = binary.Uvarint(data)
+	if n <= 0 || count == 0 {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	return first, count, data[n:], nil
+}
@@ -0,0 +1,209 @@
+package log
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+var compressions = []Compression{CompressionSnappy, CompressionZstd, CompressionGzip}
+
+// jsonRecord returns a record which compresses well, like the JSON payloads written to a WAL.
+func jsonRecord(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order.created","status":"pending","currency":"EUR","items":[]}`, i))
+}
+
+func TestCompression(t *testing.T) {
+	for _, c := range compressions {
+		records := [][]byte{jsonRecord(0), jsonRecord(1), {}}
+		data, err := c.encodeBatch(42, records)
+		require.NoError(t, err)
+		first, count, _, err := batchHeader(data)
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), first)
+		require.Equal(t, uint64(3), count)
+
+		first, decoded, err := c.decodeBatch(data)
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), first)
+		require.Len(t, decoded, 3)
+		for i := range records {
+			require.Equal(t, string(records[i]), string(decoded[i]))
+		}
+
+		data[len(data)-1] ^= 0xff
+		_, _, err = c.decodeBatch(data)
+		require.ErrorIs(t, err, ErrCorruptRecord, "compression %d", c)
+	}
+
+	_, err := compressionCount.compress(nil, []byte("a"))
+	require.ErrorIs(t, err, ErrUnknownCompression)
+	_, err = NewLog(os.TempDir(), Config{Compression: compressionCount})
+	require.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+func TestLogCompression(t *testing.T) {
+	for _, c := range compressions {
+		t.Run(fmt.Sprintf("compression %d", c), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compression-test")
+			require.NoError(t, err)
+			defer func(path string) {
+				err := os.RemoveAll(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(dir)
+
+			// the records do not fit in a segment uncompressed.
+			config := Config{
+				SegmentConfig: SegmentConfig{
+					MaxSegmentSize: 4096,
+					MaxIndexSize:   1024,
+				},
+				Compression: c,
+			}
+			log, err := NewLog(dir, config)
+			require.NoError(t, err)
+
+			// a record appended alone does not get smaller, it is not compressed.
+			_, err = log.Append([]byte("a"))
+			require.NoError(t, err)
+			size := uint64(0)
+			for i := 1; i < 57; i += 8 {
+				batch := make([][]byte, 0, 8)
+				for j := i; j < i+8; j++ {
+					batch = append(batch, jsonRecord(j))
+					size += uint64(len(jsonRecord(j)))
+				}
+				_, _, err := log.AppendBatch(batch)
+				require.NoError(t, err)
+			}
+			require.Greater(t, size, config.SegmentConfig.MaxSegmentSize)
+			require.Less(t, log.SizeBytes(), size/2)
+			require.Equal(t, 1, len(log.segments))
+			require.NoError(t, log.Close())
+
+			log, err = NewLog(dir, config)
+			require.NoError(t, err)
+			defer func(log *Log) {
+				err := log.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(log)
+			require.Empty(t, log.RecoveryReports())
+			report, err := log.RepairSegment(0)
+			require.NoError(t, err)
+			require.False(t, report.Repaired())
+
+			data, err := log.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, "a", string(data))
+			for i := 1; i < 57; i++ {
+				data, err := log.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, string(jsonRecord(i)), string(data))
+				require.NoError(t, log.View(uint64(i), func(value []byte) error {
+					require.Equal(t, string(jsonRecord(i)), string(value))
+					return nil
+				}))
+			}
+
+			// a reader created in the middle of a compressed batch starts at its offset.
+			r, err := log.NewReader(12)
+			require.NoError(t, err)
+			defer r.Close()
+			for i := 12; i < 57; i++ {
+				record, err := r.Next()
+				require.NoError(t, err)
+				require.Equal(t, uint64(i), record.Offset)
+				require.Equal(t, string(jsonRecord(i)), string(record.Value))
+			}
+			_, err = r.Next()
+			require.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestMixedCompression(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	// every reopen appends to the same segment with another compression.
+	var offset uint64
+	for _, c := range append([]Compression{CompressionNone}, compressions...) {
+		log, err := NewLog(dir, Config{SegmentConfig: defaultConfig.SegmentConfig, Compression: c})
+		require.NoError(t, err)
+		_, last, err := log.AppendBatch([][]byte{jsonRecord(int(offset)), jsonRecord(int(offset + 1))})
+		require.NoError(t, err)
+		offset = last + 1
+		require.NoError(t, log.Close())
+	}
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Equal(t, 1, len(log.segments))
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := uint64(0); i < offset; i++ {
+		data, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, string(jsonRecord(int(i))), string(data))
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+	}
+}
+
+func TestRecoverCompressedBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{SegmentConfig: defaultConfig.SegmentConfig, Compression: CompressionSnappy}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	_, _, err = log.AppendBatch([][]byte{jsonRecord(0), jsonRecord(1), jsonRecord(2), jsonRecord(3)})
+	require.NoError(t, err)
+
+	// the process died after writing the first index entries of the batch.
+	log.activeSegment.index.truncate(2)
+	crash(t, log)
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Len(t, log.RecoveryReports(), 1)
+	require.Equal(t, uint64(2), log.RecoveryReports()[0].RebuiltIndexEntries)
+	require.Equal(t, uint64(4), log.activeSegment.nextOffset.Load())
+	for i := 0; i < 4; i++ {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, string(jsonRecord(i)), string(data))
+	}
+}
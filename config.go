@@ -1,10 +1,107 @@
 package log
 
+import "time"
+
 type SegmentConfig struct {
 	MaxSegmentSize uint64
 	MaxIndexSize   uint64
+	// TimeIndexInterval is the number of bytes appended to a segment between two entries of its time index. It is
+	// 4096 if zero.
+	TimeIndexInterval uint64
+}
+
+// timeIndexInterval returns the number of bytes appended between two entries of the time index.
+func (c SegmentConfig) timeIndexInterval() uint64 {
+	if c.TimeIndexInterval == 0 {
+		return defaultTimeIndexInterval
+	}
+	return c.TimeIndexInterval
+}
+
+// GroupCommitConfig configures the group commit of Log.Append. Concurrent appends are queued, written together and
+// made durable by a single sync of the store and the index.
+type GroupCommitConfig struct {
+	// MaxBatchSize is the max number of appends made durable by one sync. Group commit is disabled if it is zero.
+	MaxBatchSize int
+	// MaxWait is how long a batch waits for more appends before it is written. A batch only takes the appends already
+	// queued if it is zero.
+	MaxWait time.Duration
+}
+
+// SyncPolicy decides when appended records are committed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs every append before it returns. It is the default.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs in the background every SyncConfig.Interval, and as soon as SyncConfig.Bytes bytes are
+	// appended since the last sync. Records appended since the last sync may be lost by a crash.
+	SyncInterval
+	// SyncNever only syncs on Log.Sync, Log.Close and when a segment is rolled.
+	SyncNever
+)
+
+type SyncConfig struct {
+	Policy SyncPolicy
+	// Interval is the period of the background sync of SyncInterval. There is no periodic sync if it is zero.
+	Interval time.Duration
+	// Bytes is the amount of appended data which triggers a background sync of SyncInterval. There is no sync
+	// triggered by size if it is zero.
+	Bytes uint64
+}
+
+// RetentionConfig configures the deletion of the oldest segments by the log. The active segment and the segments
+// used by a Reader are never deleted. Retention is disabled if none of the limits is set.
+type RetentionConfig struct {
+	// MaxBytes is the max size of the records of the log.
+	MaxBytes uint64
+	// MaxAge is the max time since the last append to a segment.
+	MaxAge time.Duration
+	// MaxSegments is the max number of segments of the log.
+	MaxSegments int
+	// CheckInterval is the period of the retention check, it is a minute if zero.
+	CheckInterval time.Duration
+	// OnDelete is called with every segment deleted by retention.
+	OnDelete func(info SegmentInfo)
+}
+
+// SnapshotConfig configures the snapshots saved by Log.SaveSnapshot.
+type SnapshotConfig struct {
+	// MaxSnapshots is the number of snapshots kept, the oldest ones are deleted when a snapshot is saved. It is 1 if
+	// zero.
+	MaxSnapshots int
+}
+
+// maxSnapshots returns the number of snapshots kept.
+func (c SnapshotConfig) maxSnapshots() int {
+	if c.MaxSnapshots <= 0 {
+		return 1
+	}
+	return c.MaxSnapshots
 }
 
 type Config struct {
 	SegmentConfig SegmentConfig
+	GroupCommit   GroupCommitConfig
+	Sync          SyncConfig
+	Retention     RetentionConfig
+	Snapshot      SnapshotConfig
+	// Codec encodes the records of the new segments, it is ProtoCodec if nil. The segments written with another
+	// codec are decoded with the codec recorded in their header, which is either Codec or one of the codecs of this
+	// package.
+	Codec Codec
+	// Compression compresses the records appended to the log, they are not compressed if it is CompressionNone. The
+	// records of an append, or of a batch of AppendBatch, are compressed together into a single frame, unless it
+	// does not make them smaller. MaxSegmentSize limits the compressed size of the records.
+	Compression Compression
+	// KeyProvider supplies the keys the payloads of the store files are encrypted with by AES-GCM, they are not
+	// encrypted if it is nil. The new segments are encrypted with its current key, see Log.RotateKey.
+	KeyProvider KeyProvider
+	// InitialOffset is the offset of the first record of a new log. It is ignored once the log is created.
+	InitialOffset uint64
+	// ReadOnly opens the log to inspect it, for instance while another process appends to it. A read-only log does not
+	// take the lock of the directory and never writes to it: it does not repair the segments nor complete an
+	// interrupted truncation, it only reads the records written when it was opened, and the methods changing the log
+	// return ErrReadOnly.
+	ReadOnly bool
 }
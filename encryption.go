@@ -0,0 +1,181 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// KeyProvider supplies the keys the store files are encrypted with. The ID of the key of a segment is recorded in the
+// header of its store file, so a key is rotated by rolling to a new segment while the older segments stay readable
+// with their keys.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key the new segments are encrypted with. The IDs are not zero.
+	CurrentKeyID() (uint32, error)
+	// Key returns the key with the given ID. It is 16, 24 or 32 bytes long, to select AES-128, AES-192 or AES-256.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory.
+type StaticKeys struct {
+	// Current is the ID of the key the new segments are encrypted with.
+	Current uint32
+	// Keys are the keys by ID.
+	Keys map[uint32][]byte
+}
+
+func (k StaticKeys) CurrentKeyID() (uint32, error) {
+	if _, ok := k.Keys[k.Current]; !ok || k.Current == 0 {
+		return 0, ErrUnknownKey
+	}
+	return k.Current, nil
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// RotateKey rolls the log to a new segment encrypted with the current key of Config.KeyProvider, unless the active
+// segment is encrypted with it already. The active segment takes the current key in place if it holds no record. The
+// older segments stay readable with their keys, so the KeyProvider must keep a key until the segments encrypted with
+// it are deleted.
+func (l *Log) RotateKey() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return err
+	}
+
+	id, err := l.Config.currentKeyID()
+	if err != nil {
+		return err
+	}
+	seg := l.activeSegment
+	if seg.store.keyID == id {
+		return nil
+	}
+	if seg.nextOffset.Load() > seg.baseOffset {
+		return l.newSegment(seg.nextOffset.Load())
+	}
+	var aead cipher.AEAD
+	if id != 0 {
+		if aead, err = l.Config.newAEAD(id); err != nil {
+			return err
+		}
+	}
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	return seg.store.setKey(id, aead)
+}
+
+// currentKeyID returns the ID of the key the new segments are encrypted with, zero if they are not encrypted.
+func (c Config) currentKeyID() (uint32, error) {
+	if c.KeyProvider == nil {
+		return 0, nil
+	}
+	id, err := c.KeyProvider.CurrentKeyID()
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, ErrUnknownKey
+	}
+	return id, nil
+}
+
+// newAEAD returns the AES-GCM cipher of the key with the given ID.
+func (c Config) newAEAD(id uint32) (cipher.AEAD, error) {
+	if c.KeyProvider == nil {
+		return nil, ErrUnknownKey
+	}
+	key, err := c.KeyProvider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// setKey records the ID of the key the payloads are encrypted with in the header, and makes aead encrypt them. The
+// payloads are no longer encrypted if id is zero. The store must not have frames yet.
+func (s *Store) setKey(id uint32, aead cipher.AEAD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := make([]byte, keyIDWidth)
+	endian.PutUint32(buf, id)
+	if _, err := s.File.WriteAt(buf, keyIDPos); err != nil {
+		return err
+	}
+	features := s.features &^ featureEncryption
+	if id != 0 {
+		features |= featureEncryption
+	}
+	if err := s.setFeatures(features); err != nil {
+		return err
+	}
+	if err := fdatasync(s.File); err != nil {
+		return err
+	}
+	s.keyID = id
+	s.aead = aead
+	return nil
+}
+
+// encryptionOverhead returns the number of bytes the encryption adds to a payload: the nonce and the authentication
+// tag.
+func (s *Store) encryptionOverhead() uint64 {
+	if s.aead == nil {
+		return 0
+	}
+	return uint64(s.aead.NonceSize() + s.aead.Overhead())
+}
+
+// encrypt returns the payload of the frame at pos encrypted with a random nonce, which is prepended to it. The
+// position, the base offset of the segment and the key ID are authenticated with the payload, so a frame copied to
+// another position or to another segment does not decrypt.
+func (s *Store) encrypt(pos uint64, data []byte) ([]byte, error) {
+	if s.aead == nil {
+		return data, nil
+	}
+	buf := make([]byte, s.aead.NonceSize(), uint64(len(data))+s.encryptionOverhead())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(buf, buf, data, s.additionalData(pos)), nil
+}
+
+// decrypt returns the decrypted payload of the frame at pos. A payload which does not decrypt is reported as
+// ErrCorruptRecord.
+func (s *Store) decrypt(pos uint64, data []byte) ([]byte, error) {
+	if s.aead == nil {
+		return data, nil
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, ErrCorruptRecord
+	}
+	nonce, data := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, data, s.additionalData(pos))
+	if err != nil {
+		return nil, ErrCorruptRecord
+	}
+	return data, nil
+}
+
+// additionalData returns the data authenticated with the payload of the frame at pos: its position, the base offset
+// of the segment and the ID of the key.
+func (s *Store) additionalData(pos uint64) []byte {
+	buf := make([]byte, 0, posWidth+baseOffsetWidth+keyIDWidth)
+	buf = endian.AppendUint64(buf, pos)
+	buf = endian.AppendUint64(buf, s.baseOffset)
+	return endian.AppendUint32(buf, s.keyID)
+}
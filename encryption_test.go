@@ -0,0 +1,167 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+func testKeys(current uint32) StaticKeys {
+	return StaticKeys{
+		Current: current,
+		Keys: map[uint32][]byte{
+			1: bytes.Repeat([]byte{1}, 16),
+			2: bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{SegmentConfig: defaultConfig.SegmentConfig, KeyProvider: testKeys(1)}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := log.Append([]byte(fmt.Sprintf("secret-%d", i)))
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint32(1), log.activeSegment.store.keyID)
+	require.Equal(t, featureChecksum|featureEncryption, log.activeSegment.store.features)
+
+	// the key is rotated once the provider has a new current key.
+	require.NoError(t, log.RotateKey())
+	require.Equal(t, 1, len(log.segments))
+	config.KeyProvider = testKeys(2)
+	log.Config = config
+	require.NoError(t, log.RotateKey())
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, uint32(2), log.activeSegment.store.keyID)
+	_, _, err = log.AppendBatch([][]byte{[]byte("secret-4"), []byte("secret-5")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	for _, seg := range log.segments {
+		data, err := os.ReadFile(seg.StoreFileName())
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secret")
+	}
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Empty(t, log.RecoveryReports())
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := 0; i < 6; i++ {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("secret-%d", i), string(data))
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("secret-%d", i), string(record.Value))
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+	report, err := log.RepairSegment(4)
+	require.NoError(t, err)
+	require.False(t, report.Repaired())
+
+	// a frame does not decrypt at another position.
+	seg := log.segments[0]
+	_, pos, err := seg.index.Read(1)
+	require.NoError(t, err)
+	f, err := seg.store.readRawFrame(pos)
+	require.NoError(t, err)
+	_, err = seg.store.decrypt(pos+1, f.data)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+
+	// nor in another segment, or recorded with another key ID.
+	seg.store.baseOffset++
+	_, err = seg.store.decrypt(pos, f.data)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	seg.store.baseOffset--
+	seg.store.keyID++
+	_, err = seg.store.decrypt(pos, f.data)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	seg.store.keyID--
+	_, err = seg.store.decrypt(pos, f.data)
+	require.NoError(t, err)
+}
+
+func TestEncryptionUnknownKey(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, Config{SegmentConfig: defaultConfig.SegmentConfig, KeyProvider: testKeys(1)})
+	require.NoError(t, err)
+	_, err = log.Append([]byte("secret"))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = NewLog(dir, defaultConfig)
+	require.ErrorIs(t, err, ErrUnknownKey)
+	_, err = NewLog(dir, Config{SegmentConfig: defaultConfig.SegmentConfig, KeyProvider: StaticKeys{Current: 3}})
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncryptionTruncateCompressedBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: defaultConfig.SegmentConfig,
+		Compression:   CompressionSnappy,
+		KeyProvider:   testKeys(2),
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	_, _, err = log.AppendBatch([][]byte{jsonRecord(0), jsonRecord(1), jsonRecord(2), jsonRecord(3)})
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(2))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Empty(t, log.RecoveryReports())
+	require.Equal(t, uint64(2), log.activeSegment.nextOffset.Load())
+	for i := 0; i < 2; i++ {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, string(jsonRecord(i)), string(data))
+	}
+}
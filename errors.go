@@ -1,8 +1,69 @@
 package log
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrExceededMaxSegmentSize = errors.New("exceeded max segment size")
 	ErrIllegalOffsetRange     = errors.New("offset is not in correct range")
+	ErrCorruptRecord          = errors.New("corrupt record")
+	ErrLegacyFormat           = errors.New("can not append to a store in legacy format")
+	ErrSegmentNotFound        = errors.New("segment not found")
+	ErrLogClosed              = errors.New("log is closed")
+	ErrEmptyBatch             = errors.New("batch is empty")
+	ErrReaderClosed           = errors.New("reader is closed")
+	ErrEmptyLog               = errors.New("log is empty")
+	ErrUnknownCodec           = errors.New("unknown codec")
+	ErrUnknownCompression     = errors.New("unknown compression")
+	ErrUnknownKey             = errors.New("unknown encryption key")
+	ErrNoRecordAfterTime      = errors.New("no record at or after time")
+	ErrLogLocked              = errors.New("log is locked by another process")
+	ErrLockUnsupported        = errors.New("locking the log is not supported on this platform")
+	ErrReadOnly               = errors.New("log is read-only")
+	ErrUnknownFormat          = errors.New("unknown segment format")
+	ErrCorruptManifest        = errors.New("corrupt manifest")
+	ErrNoSnapshot             = errors.New("no snapshot")
+	ErrLogFailed              = errors.New("log failed")
 )
+
+// CorruptRecordError describes a record whose frame in the store file fails the checksum verification.
+// It matches ErrCorruptRecord with errors.Is.
+type CorruptRecordError struct {
+	// BaseOffset is the base offset of the segment which the record belongs to.
+	BaseOffset uint64
+	// Offset is the offset of the record.
+	Offset uint64
+	// Pos is the position of the frame in the store file.
+	Pos uint64
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record: segment %d, offset %d, position %d", e.BaseOffset, e.Offset, e.Pos)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return ErrCorruptRecord
+}
+
+// FormatError describes a store file which can not be read: its header has a format version or a feature unknown to
+// this version of the package, or the base offset of another segment. It matches ErrUnknownFormat with errors.Is.
+type FormatError struct {
+	// File is the name of the store file.
+	File string
+	// Version and Features are the format version and the features recorded in the header.
+	Version  uint32
+	Features uint32
+	// BaseOffset is the base offset recorded in the header.
+	BaseOffset uint64
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("unknown segment format: file %s, version %d, features %#x, base offset %d", e.File, e.Version,
+		e.Features, e.BaseOffset)
+}
+
+func (e *FormatError) Unwrap() error {
+	return ErrUnknownFormat
+}
@@ -1,17 +1,18 @@
 module github.com/yongsheng1992/yawal
 
-go 1.19
+go 1.22
 
 require (
 	github.com/edsrzf/mmap-go v1.1.0
-	github.com/golang/protobuf v1.5.0
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	google.golang.org/protobuf v1.30.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
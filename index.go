@@ -1,6 +1,7 @@
 package log
 
 import (
+	"errors"
 	"github.com/edsrzf/mmap-go"
 	"io"
 	"os"
@@ -12,10 +13,20 @@ const (
 	entWidth = offWidth + posWidth
 )
 
+// Index maps the relative offsets of the records of a segment to the positions of their frames in the store file. An
+// entry is the relative offset followed by the position.
+//
+// Unlike the store file, the index file has no header. It only holds data derived from the store file, whose header
+// records the format of the segment, and an index which does not point to the frames of the store is rebuilt from it
+// when the log is opened. A change to the index format therefore comes with a new store format version, which tells
+// how the index of a segment is read or that it has to be rebuilt.
 type Index struct {
 	*os.File
 	size uint64
 	mmap mmap.MMap
+	// readOnly is set if the index belongs to a read-only log. The index file is then read into mmap instead of being
+	// mapped, as the writer of the log may truncate it, and it is never written to.
+	readOnly bool
 }
 
 func newIndex(f *os.File, config Config) (*Index, error) {
@@ -27,6 +38,14 @@ func newIndex(f *os.File, config Config) (*Index, error) {
 		File: f,
 		size: uint64(fi.Size()),
 	}
+	if config.ReadOnly {
+		idx.readOnly = true
+		idx.mmap = make(mmap.MMap, max(uint64(fi.Size()), config.SegmentConfig.MaxIndexSize))
+		if _, err := f.ReadAt(idx.mmap[:fi.Size()], 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return idx, nil
+	}
 	if err := os.Truncate(f.Name(), int64(config.SegmentConfig.MaxIndexSize)); err != nil {
 		return nil, err
 	}
@@ -42,11 +61,19 @@ func (idx *Index) Read(off uint64) (n uint64, pos uint64, err error) {
 	if idx.size == 0 {
 		return 0, 0, io.EOF
 	}
-	posInIndex := off * entWidth
-	if posInIndex > idx.size {
+	if off*entWidth+entWidth > idx.size {
 		return 0, 0, io.EOF
 	}
+	return idx.entry(off)
+}
 
+// entry reads the entry off without checking it against the size of the index, which is only read by the writer. The
+// readers of a segment check the offset against its high-water mark instead.
+func (idx *Index) entry(off uint64) (n uint64, pos uint64, err error) {
+	posInIndex := off * entWidth
+	if posInIndex+entWidth > uint64(len(idx.mmap)) {
+		return 0, 0, io.EOF
+	}
 	n = endian.Uint64(idx.mmap[posInIndex : posInIndex+offWidth])
 	pos = endian.Uint64(idx.mmap[posInIndex+offWidth : posInIndex+entWidth])
 	return n, pos, nil
@@ -54,27 +81,45 @@ func (idx *Index) Read(off uint64) (n uint64, pos uint64, err error) {
 
 // Write writes the offset and its position in the segment.
 func (idx *Index) Write(off uint64, pos uint64) error {
+	if err := idx.write(off, pos); err != nil {
+		return err
+	}
+	return idx.Sync()
+}
+
+// write writes the offset and its position in the segment without flushing the mapped region.
+func (idx *Index) write(off uint64, pos uint64) error {
 	if uint64(len(idx.mmap)) < idx.size+entWidth {
 		return io.EOF
 	}
 	endian.PutUint64(idx.mmap[idx.size:idx.size+offWidth], off)
 	endian.PutUint64(idx.mmap[idx.size+offWidth:idx.size+entWidth], pos)
 	idx.size += entWidth
-	if err := idx.mmap.Flush(); err != nil {
-		return err
-	}
 	return nil
 }
 
+// Sync flushes the mapped region to the index file.
+func (idx *Index) Sync() error {
+	if idx.readOnly {
+		return nil
+	}
+	return idx.mmap.Flush()
+}
+
 func (idx *Index) Close() error {
+	if idx.readOnly {
+		return idx.File.Close()
+	}
 	if err := idx.mmap.Flush(); err != nil {
 		return err
 	}
-	if err := os.Truncate(idx.File.Name(), int64(idx.size)); err != nil {
+	if err := idx.mmap.Unmap(); err != nil {
 		return err
 	}
-
-	return idx.mmap.Unmap()
+	if err := idx.File.Truncate(int64(idx.size)); err != nil {
+		return err
+	}
+	return idx.File.Close()
 }
 
 func (idx *Index) Size() uint64 {
@@ -92,3 +137,39 @@ func (idx *Index) Last() (uint64, error) {
 	n := endian.Uint64(idx.mmap[pos : pos+offWidth])
 	return n, nil
 }
+
+// entries returns the number of entries which fit in both the size and the mapped region of the index.
+func (idx *Index) entries() uint64 {
+	size := idx.size
+	if uint64(len(idx.mmap)) < size {
+		size = uint64(len(idx.mmap))
+	}
+	return size / entWidth
+}
+
+// copyEntries returns a copy of the entries.
+func (idx *Index) copyEntries() []byte {
+	entries := make([]byte, idx.entries()*entWidth)
+	copy(entries, idx.mmap)
+	return entries
+}
+
+// restore replaces the entries by a copy returned by copyEntries.
+func (idx *Index) restore(entries []byte) {
+	idx.truncate(0)
+	copy(idx.mmap, entries)
+	idx.size = uint64(len(entries))
+}
+
+// truncate keeps the first n entries and zeroes the others, so the discarded entries are not mistaken for entries
+// by recovery once the index is written past them again.
+func (idx *Index) truncate(n uint64) {
+	end := idx.size
+	if end > uint64(len(idx.mmap)) {
+		end = uint64(len(idx.mmap))
+	}
+	for i := n * entWidth; i < end; i++ {
+		idx.mmap[i] = 0
+	}
+	idx.size = n * entWidth
+}
@@ -0,0 +1,23 @@
+package log
+
+import (
+	"os"
+	"path"
+)
+
+// lockFileName is the name of the file locked by the log which writes to a directory.
+const lockFileName = "LOCK"
+
+// lockDir takes the exclusive lock of the log in dir. It is held until the returned file is closed, and released by the
+// system if the process dies. ErrLogLocked is returned if another log holds it, in this process or in another one.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package log
+
+import "os"
+
+// lockFile returns ErrLockUnsupported where neither flock nor LockFileEx is available, the directory can not be
+// locked.
+func lockFile(f *os.File) error {
+	return ErrLockUnsupported
+}
@@ -0,0 +1,151 @@
+package log
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogLocked(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lock-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	_, err = NewLog(dir, defaultConfig)
+	require.ErrorIs(t, err, ErrLogLocked)
+	require.NoError(t, log.Close())
+
+	// the lock is released by Close.
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	// a segment which fails to close does not keep the others open, nor the lock held.
+	require.NoError(t, log.segments[0].store.File.Close())
+	require.ErrorIs(t, log.Close(), os.ErrClosed)
+	for _, seg := range log.segments {
+		require.ErrorIs(t, seg.index.File.Close(), os.ErrClosed)
+		require.ErrorIs(t, seg.timeIndex.File.Close(), os.ErrClosed)
+	}
+	require.ErrorIs(t, log.activeSegment.store.File.Close(), os.ErrClosed)
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lock-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{SegmentConfig: defaultConfig.SegmentConfig, ReadOnly: true}
+	_, err = NewLog(dir, config)
+	require.ErrorIs(t, err, ErrEmptyLog)
+
+	writerConfig := Config{SegmentConfig: defaultConfig.SegmentConfig, Compression: CompressionSnappy}
+	writer, err := NewLog(dir, writerConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(writer)
+	for i := 0; i < 30; i++ {
+		_, err := writer.Append([]byte(fmt.Sprintf("record-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = writer.AppendBatch([][]byte{jsonRecord(30), jsonRecord(31), jsonRecord(32)})
+	require.NoError(t, err)
+	require.Greater(t, len(writer.segments), 1)
+	storeSize, err := writer.activeSegment.store.Size()
+	require.NoError(t, err)
+
+	// a read-only log opens the log while the writer holds the lock, and sees the records appended so far.
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	require.Equal(t, len(writer.segments), len(log.segments))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), highest)
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	for i := 0; i < 33; i++ {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		if i < 30 {
+			require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+		} else {
+			require.Equal(t, string(jsonRecord(i)), string(record.Value))
+		}
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, r.Close())
+
+	_, err = log.Append([]byte("a"))
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, _, err = log.AppendBatch([][]byte{[]byte("a")})
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, log.Truncate(0), ErrReadOnly)
+	require.ErrorIs(t, log.Compact(0), ErrReadOnly)
+	require.ErrorIs(t, log.RotateKey(), ErrReadOnly)
+	_, err = log.RepairSegment(0)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.NoError(t, log.Close())
+
+	// the files of the writer are left as they are, and it keeps appending.
+	size, err := writer.activeSegment.store.Size()
+	require.NoError(t, err)
+	require.Equal(t, storeSize, size)
+	offset, err := writer.Append([]byte("record-33"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(33), offset)
+	data, err := writer.Read(31)
+	require.NoError(t, err)
+	require.Equal(t, string(jsonRecord(31)), string(data))
+
+	// the segments written before the time index have no time index file, a read-only log searches their records.
+	segments, err := writer.Segments()
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	for _, seg := range segments {
+		require.NoError(t, os.Remove(seg.TimeIndexFileName))
+	}
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	offset, err = log.OffsetForTime(time.Unix(0, 0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	_, err = log.OffsetForTime(time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, ErrNoRecordAfterTime)
+	infos, err := log.Segments()
+	require.NoError(t, err)
+	require.Len(t, infos, len(segments))
+	require.Empty(t, infos[0].TimeIndexFileName)
+	require.NoError(t, log.Close())
+	for _, seg := range segments {
+		_, err = os.Stat(seg.TimeIndexFileName)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package log
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile takes an exclusive lock on the first byte of f without waiting for it. Like flock, the lock belongs to the
+// open file, so two logs of the same process opening the directory exclude each other as well.
+func lockFile(f *os.File) error {
+	var ol windows.Overlapped
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, &ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLogLocked
+	}
+	return err
+}
@@ -1,54 +1,125 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	log_v1 "github.com/yongsheng1992/yawal/api/v1"
 	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Log struct {
+	// mu serializes the writers of the log. Readers do not take it: they find segments in view, a copy of
+	// segments which is replaced whenever segments changes, and read the records below the high-water mark of a
+	// segment while it is appended to.
 	mu            sync.Mutex
 	segments      []*Segment
+	view          atomic.Pointer[[]*Segment]
 	activeSegment *Segment
+	recovery      []*RecoveryReport
 	Config        Config
 
 	Dir string
+	// lock is the file holding the lock of the directory, nil for a read-only log.
+	lock *os.File
+
+	// closeMu guards closed and sending to appends, so appends is only closed when no Append is sending to it.
+	closeMu sync.RWMutex
+	closed  bool
+	appends chan *appendRequest
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	// unsynced is the amount of data appended since the last sync.
+	unsynced uint64
+	// syncErr is the error of the last background sync, it is returned by the next Sync.
+	syncErr error
+	// syncs triggers a background sync.
+	syncs chan struct{}
+
+	// appended is closed when records are appended, and replaced by a new channel. It is guarded by notifyMu, so
+	// subscribers do not wait for the writers to take it.
+	notifyMu sync.Mutex
+	appended chan struct{}
+
+	// snapshotMu serializes the snapshots saved by SaveSnapshot.
+	snapshotMu sync.Mutex
+
+	// failed is the error which left the files of the log out of line with its segments, it is returned by the methods
+	// of the log from then on. The log is recovered from its files when it is reopened.
+	failed atomic.Pointer[error]
 }
 
+// NewLog opens the log in dir, and creates it if there is no segment. The log takes an exclusive lock on the directory
+// until it is closed, so ErrLogLocked is returned if another log has it open, unless config.ReadOnly is set. On the
+// platforms where the directory can not be locked, ErrLockUnsupported is returned unless config.ReadOnly is set.
 func NewLog(dir string, config Config) (*Log, error) {
-	dirEntries, err := os.ReadDir(dir)
+	if !config.Compression.valid() {
+		return nil, ErrUnknownCompression
+	}
+	if config.ReadOnly {
+		return openLog(dir, config)
+	}
+
+	lock, err := lockDir(dir)
 	if err != nil {
 		return nil, err
 	}
+	log, err := openLog(dir, config)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	log.lock = lock
+	return log, nil
+}
 
-	baseOffsets := make([]uint64, 0)
-	for _, entry := range dirEntries {
-		if path.Ext(entry.Name()) != ".store" {
-			continue
+// openLog opens the segments listed in the manifest of the log in dir, and repairs them unless config.ReadOnly is set.
+// The files of the segments which are not listed are removed. The segments of a log written before the manifest are
+// found from their store files.
+func openLog(dir string, config Config) (*Log, error) {
+	m, ok, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if m.segments, err = scanSegments(dir); err != nil {
+			return nil, err
 		}
-		offsetStr := strings.Trim(entry.Name(), path.Ext(entry.Name()))
-		offset, err := strconv.ParseUint(offsetStr, 10, 0)
-		if err != nil {
+		m.baseOffset = config.InitialOffset
+		if len(m.segments) > 0 {
+			m.baseOffset = m.segments[0]
+		}
+	}
+	if !config.ReadOnly {
+		if err := collectGarbage(dir, m.segments); err != nil {
 			return nil, err
 		}
-		baseOffsets = append(baseOffsets, offset)
+		if !ok {
+			if err := writeManifest(dir, m); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-
 	log := &Log{
 		segments: make([]*Segment, 0),
 		Config:   config,
 		Dir:      dir,
+		closing:  make(chan struct{}),
+		appended: make(chan struct{}),
 	}
-	for i := 0; i < len(baseOffsets); i++ {
-		baseOffset := baseOffsets[i]
+	for i, baseOffset := range m.segments {
+		// The store file of a listed segment exists, but the one of the active segment if the process died while it
+		// replaced it by an empty segment of the current format. It is created again.
+		if i < len(m.segments)-1 {
+			if _, err := os.Stat(segmentFileName(dir, baseOffset, ".store")); err != nil {
+				return nil, err
+			}
+		}
 		seg, err := newSegment(dir, baseOffset, config)
 		if err != nil {
 			return nil, err
@@ -57,109 +128,576 @@ func NewLog(dir string, config Config) (*Log, error) {
 	}
 
 	n := len(log.segments)
+	if config.ReadOnly {
+		if n == 0 {
+			return nil, ErrEmptyLog
+		}
+		log.activeSegment = log.segments[n-1]
+		if err := log.loadTimestamps(); err != nil {
+			return nil, err
+		}
+		log.publish()
+		return log, nil
+	}
 	if n == 0 {
-		if err := log.newSegment(uint64(0)); err != nil {
+		if err := log.newSegment(m.baseOffset); err != nil {
 			return nil, err
 		}
 	} else {
 		log.activeSegment = log.segments[n-1]
+		if err := log.repair(); err != nil {
+			return nil, err
+		}
+		if err := log.resumeTruncate(); err != nil {
+			return nil, err
+		}
+		if err := log.loadTimestamps(); err != nil {
+			return nil, err
+		}
+		for _, seg := range log.segments[:len(log.segments)-1] {
+			if err := seg.sealTimeIndex(); err != nil {
+				return nil, err
+			}
+			if err := seg.timeIndex.Sync(); err != nil {
+				return nil, err
+			}
+			if err := seg.store.mapFile(); err != nil {
+				return nil, err
+			}
+		}
+		if err := log.ensureAppendable(); err != nil {
+			return nil, err
+		}
+		if err := log.activeSegment.preallocate(); err != nil {
+			return nil, err
+		}
+	}
+
+	log.publish()
+
+	if config.GroupCommit.MaxBatchSize > 0 {
+		log.appends = make(chan *appendRequest, config.GroupCommit.MaxBatchSize)
+		log.wg.Add(1)
+		go log.commitLoop()
+	}
+	if config.Sync.Policy == SyncInterval {
+		log.syncs = make(chan struct{}, 1)
+		log.wg.Add(1)
+		go log.syncLoop()
+	}
+	if config.Retention.enabled() {
+		log.wg.Add(1)
+		go log.retentionLoop()
 	}
 	return log, nil
 }
 
-func (l *Log) Append(data []byte) (uint64, error) {
+// repair recovers the tail of the active segment and rebuilds the index of every segment whose index and store
+// disagree.
+func (l *Log) repair() error {
+	report, err := l.activeSegment.recover()
+	if err != nil {
+		return err
+	}
+	if report.Repaired() {
+		l.recovery = append(l.recovery, report)
+	}
+	for _, seg := range l.segments {
+		if seg.consistent() {
+			continue
+		}
+		report, err := seg.rebuildIndex(seg == l.activeSegment)
+		if err != nil {
+			return err
+		}
+		l.recovery = append(l.recovery, report)
+	}
+	return nil
+}
+
+// loadTimestamps finds the greatest timestamps of the segments, and discards the entries of their time indexes beyond
+// their last records.
+func (l *Log) loadTimestamps() error {
+	prev := int64(0)
+	for _, seg := range l.segments {
+		if err := seg.loadTimestamps(prev); err != nil {
+			return err
+		}
+		prev = seg.maxTimestamp.Load()
+	}
+	return nil
+}
+
+// RecoveryReports returns what was repaired when the log was opened, one report for every repaired segment.
+func (l *Log) RecoveryReports() []*RecoveryReport {
+	return l.recovery
+}
+
+// RepairSegment rebuilds the index of the segment with the given base offset from its store file. A torn frame at the
+// tail of the active segment is truncated. A CorruptRecordError is returned for a frame of a sealed segment which can
+// not be indexed, and the segment is left as it was.
+func (l *Log) RepairSegment(baseOffset uint64) (*RecoveryReport, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrReadOnly
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return nil, err
+	}
 
-	record := &log_v1.Record{
-		Value: data,
+	i := l.searchSegment(baseOffset)
+	if i < 0 || l.segments[i].baseOffset != baseOffset {
+		return nil, ErrSegmentNotFound
 	}
+	seg := l.segments[i]
+	return seg.rebuildIndex(seg == l.activeSegment)
+}
 
-	if l.activeSegment.Size()+uint64(len(data)) > l.Config.SegmentConfig.MaxSegmentSize {
-		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
-			return 0, err
-		}
+// Append appends data to the log and returns its offset. The record is durable when Append returns if the sync
+// policy is SyncAlways.
+func (l *Log) Append(data []byte) (uint64, error) {
+	return l.AppendRecord(&log_v1.Record{Value: data})
+}
+
+// AppendRecord appends record to the log and returns its offset. The key, the headers and the type of record are kept.
+// The offset of record is set, and so is its timestamp to the time of the append unless it is already set. The record
+// is durable when AppendRecord returns if the sync policy is SyncAlways.
+func (l *Log) AppendRecord(record *log_v1.Record) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if l.Config.GroupCommit.MaxBatchSize > 0 {
+		return l.enqueue(record)
 	}
 
-	offset, err := l.activeSegment.Append(record)
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	if err != err {
+	offset, seg, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.commitSegments(seg); err != nil {
 		return 0, err
 	}
-
 	return offset, nil
 }
 
-func (l *Log) Read(offset uint64) ([]byte, error) {
+// append appends record to the active segment without syncing it, and returns its offset and the segment it is
+// written to. The caller must hold the lock.
+func (l *Log) append(record *log_v1.Record) (uint64, *Segment, error) {
+	offset, seg, err := l.appendRecords([]*log_v1.Record{record})
+	if err != nil {
+		return 0, nil, err
+	}
+	l.unsynced += uint64(len(record.Value))
+	return offset, seg, nil
+}
+
+// AppendBatch appends the records of batch with contiguous offsets and returns the offsets of the first and the last
+// record. The batch is written with a single write and synced once, and it is never split across segments, so a
+// crash keeps all of its records or none of them. A new segment is rolled if the batch does not fit in the active
+// one, and ErrExceededMaxSegmentSize is returned if it does not fit in an empty segment either.
+func (l *Log) AppendBatch(batch [][]byte) (first uint64, last uint64, err error) {
+	if l.Config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if len(batch) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// todo handle read offset less than 0
-	if offset >= l.activeSegment.nextOffset {
-		return nil, ErrIllegalOffsetRange
+	records := make([]*log_v1.Record, 0, len(batch))
+	size := uint64(0)
+	for _, data := range batch {
+		records = append(records, &log_v1.Record{Value: data})
+		size += uint64(len(data))
+	}
+	first, seg, err := l.appendRecords(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.unsynced += size
+	if err := l.commitSegments(seg); err != nil {
+		return 0, 0, err
 	}
+	return first, first + uint64(len(batch)) - 1, nil
+}
 
-	target := l.activeSegment
-	var i int
-	if offset < l.activeSegment.baseOffset {
-		for i = 0; i < len(l.segments); i++ {
-			if offset >= l.segments[i].baseOffset && offset < l.segments[i].nextOffset {
-				break
-			}
+// appendRecords appends the records to the active segment without syncing them, and returns the offset of the first
+// one and the segment they are written to. The records without a timestamp are stamped with the time of the append.
+// A new segment is rolled if the records do not fit in the active one, unless it is empty. The caller must hold the
+// lock.
+func (l *Log) appendRecords(records []*log_v1.Record) (uint64, *Segment, error) {
+	if err := l.failure(); err != nil {
+		return 0, nil, err
+	}
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+
+	appendBatch := func(seg *Segment) (uint64, error) {
+		seg.mu.Lock()
+		defer seg.mu.Unlock()
+		return seg.appendBatch(records)
+	}
+
+	seg := l.activeSegment
+	first, err := appendBatch(seg)
+	if errors.Is(err, ErrExceededMaxSegmentSize) && seg.nextOffset.Load() > seg.baseOffset {
+		if err := l.newSegment(seg.nextOffset.Load()); err != nil {
+			return 0, nil, err
+		}
+		seg = l.activeSegment
+		first, err = appendBatch(seg)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return first, seg, nil
+}
+
+// appendFrames appends the longest prefix of records which fits in the active segment without syncing it, every
+// record in a frame of its own. It returns the offset of the first record, the number of records appended and the
+// segment they are written to. The records are stamped like by appendRecords, and a new segment is rolled if the first
+// record does not fit in the active one, unless it is empty. The caller must hold the lock.
+func (l *Log) appendFrames(records []*log_v1.Record) (uint64, int, *Segment, error) {
+	if err := l.failure(); err != nil {
+		return 0, 0, nil, err
+	}
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
 		}
-		if i == len(l.segments) {
-			return nil, ErrIllegalOffsetRange
+	}
+
+	appendFrames := func(seg *Segment) (uint64, int, error) {
+		seg.mu.Lock()
+		defer seg.mu.Unlock()
+		return seg.appendFrames(records)
+	}
+
+	seg := l.activeSegment
+	first, n, err := appendFrames(seg)
+	if errors.Is(err, ErrExceededMaxSegmentSize) && seg.nextOffset.Load() > seg.baseOffset {
+		if err := l.newSegment(seg.nextOffset.Load()); err != nil {
+			return 0, 0, nil, err
 		}
-		target = l.segments[i]
+		seg = l.activeSegment
+		first, n, err = appendFrames(seg)
 	}
-	record, err := target.Read(offset)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for _, record := range records[:n] {
+		l.unsynced += uint64(len(record.Value))
+	}
+	return first, n, seg, nil
+}
 
+// Read reads the value of the record of offset. It does not wait for the appends in progress, so it may return a
+// record which is appended but not synced yet.
+func (l *Log) Read(offset uint64) ([]byte, error) {
+	record, err := l.ReadRecord(offset)
 	if err != nil {
 		return nil, err
 	}
 	return record.Value, nil
 }
 
+// ReadRecord reads the record of offset with all of its fields. Like Read, it does not wait for the appends in
+// progress.
+func (l *Log) ReadRecord(offset uint64) (*log_v1.Record, error) {
+	if err := l.failure(); err != nil {
+		return nil, err
+	}
+	seg := l.acquireSegment(offset)
+	if seg == nil {
+		return nil, ErrIllegalOffsetRange
+	}
+	defer seg.release()
+
+	return seg.Read(offset)
+}
+
+// searchSegments returns the position of the last segment whose base offset is not greater than offset, or -1 if
+// offset is lower than the base offset of the first segment. The segments are sorted by base offset, so it is a
+// binary search.
+func searchSegments(segments []*Segment, offset uint64) int {
+	return sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > offset
+	}) - 1
+}
+
+// searchSegment returns the position in l.segments of the last segment whose base offset is not greater than
+// offset, or -1 if there is none. The caller must hold the lock.
+func (l *Log) searchSegment(offset uint64) int {
+	return searchSegments(l.segments, offset)
+}
+
+// findSegment returns the segment which holds the record of offset, or nil if the log does not hold it. The caller
+// must hold the lock.
+func (l *Log) findSegment(offset uint64) *Segment {
+	i := l.searchSegment(offset)
+	if i < 0 || offset >= l.segments[i].nextOffset.Load() {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// acquireSegment finds the segment which holds the record of offset in the view of the segments and acquires
+// it, or returns nil if the log does not hold it. It does not take the lock.
+func (l *Log) acquireSegment(offset uint64) *Segment {
+	segments := l.segmentsView()
+	i := searchSegments(segments, offset)
+	if i < 0 || offset >= segments[i].nextOffset.Load() || !segments[i].tryAcquire() {
+		return nil
+	}
+	return segments[i]
+}
+
+// segmentsView returns the latest view of the segments. It must not be modified.
+func (l *Log) segmentsView() []*Segment {
+	return *l.view.Load()
+}
+
+// publish replaces the view of the segments read by the readers. The caller must hold the lock.
+func (l *Log) publish() {
+	segments := make([]*Segment, len(l.segments))
+	copy(segments, l.segments)
+	l.view.Store(&segments)
+}
+
+// LowestOffset returns the offset of the oldest record of the log. It returns ErrEmptyLog if the log holds no record.
+func (l *Log) LowestOffset() (uint64, error) {
+	if err := l.failure(); err != nil {
+		return 0, err
+	}
+	segments := l.segmentsView()
+	if length(segments) == 0 {
+		return 0, ErrEmptyLog
+	}
+	return segments[0].baseOffset, nil
+}
+
+// HighestOffset returns the offset of the newest record of the log. It returns ErrEmptyLog if the log holds no
+// record.
+func (l *Log) HighestOffset() (uint64, error) {
+	if err := l.failure(); err != nil {
+		return 0, err
+	}
+	segments := l.segmentsView()
+	if length(segments) == 0 {
+		return 0, ErrEmptyLog
+	}
+	return segments[len(segments)-1].nextOffset.Load() - 1, nil
+}
+
+// Len returns the number of records of the log.
+func (l *Log) Len() uint64 {
+	return length(l.segmentsView())
+}
+
+// length returns the number of records of the segments.
+func length(segments []*Segment) uint64 {
+	return segments[len(segments)-1].nextOffset.Load() - segments[0].baseOffset
+}
+
+// SizeBytes returns the size of the records in the store files of the log. The headers of the store files and the
+// index files are not counted.
+func (l *Log) SizeBytes() uint64 {
+	var size uint64
+	for _, seg := range l.segmentsView() {
+		size += seg.Size()
+	}
+	return size
+}
+
+// Segments returns the descriptors of the segments of the log, from the oldest to the active one.
+func (l *Log) Segments() ([]SegmentInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return nil, err
+	}
+	infos := make([]SegmentInfo, 0, len(l.segments))
+	for _, seg := range l.segments {
+		info, err := seg.info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ensureAppendable makes sure records can be appended to the active segment. Segments written in an older format,
+// with another codec than the configured one or with another key than the current one stay readable, but new records
+// go to a new segment. It replaces the active segment if it holds no record. The caller must hold the lock.
+func (l *Log) ensureAppendable() error {
+	seg := l.activeSegment
+	keyID, err := l.Config.currentKeyID()
+	if err != nil {
+		return err
+	}
+	if seg.store.version == storeFormatVersion && seg.codec.ID() == l.Config.codec().ID() && seg.store.keyID == keyID {
+		return nil
+	}
+	if seg.nextOffset.Load() == seg.baseOffset {
+		if err := seg.remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+		// The previous segment is sealed already.
+		l.activeSegment = nil
+	}
+	return l.newSegment(seg.nextOffset.Load())
+}
+
 // newSegment create a new segment. This method is not concurrent safety, so the caller must hold the lock.
 func (l *Log) newSegment(baseOffset uint64) error {
-	seg, err := newSegment(l.Dir, baseOffset, l.Config)
+	prev := int64(0)
+	if n := len(l.segments); n > 0 {
+		prev = l.segments[n-1].maxTimestamp.Load()
+	}
+	seg, err := l.createSegment(baseOffset, prev)
 	if err != nil {
 		return err
 	}
-	l.segments = append(l.segments, seg)
+	// The segment is listed in the manifest once its files are created, a crash in between leaves files which are
+	// removed when the log is reopened. The previous segment is left as it is until then, so it stays the active one
+	// if the new segment can not be created.
+	segments := append(l.segments, seg)
+	if err := l.commitManifest(segments); err != nil {
+		_ = seg.Remove()
+		return err
+	}
+	prevSeg := l.activeSegment
+	l.segments = segments
 	l.activeSegment = seg
+	l.publish()
+
+	// Only the active segment is synced by Sync, so the previous one is synced once it is replaced. It is truncated to
+	// its logical end as well. The log is failed if it can not be, as its records may not be durable.
+	if prevSeg != nil {
+		if err := prevSeg.seal(); err != nil {
+			return l.fail("roll", err)
+		}
+	}
+	return nil
+}
+
+// fail marks the log failed by err, which happened while op changed its files. The returned error matches
+// ErrLogFailed, and is returned by the methods of the log from then on. The caller must hold the lock.
+func (l *Log) fail(op string, err error) error {
+	err = fmt.Errorf("%w: %s: %w", ErrLogFailed, op, err)
+	l.failed.Store(&err)
+	return err
+}
+
+// failure returns the error the log failed with, or nil if it did not fail.
+func (l *Log) failure() error {
+	if err := l.failed.Load(); err != nil {
+		return *err
+	}
 	return nil
 }
 
+// createSegment creates the files of the segment with baseOffset which follows the segments whose greatest timestamp
+// is prev, and preallocates it to become the active segment. The files are removed if it fails.
+func (l *Log) createSegment(baseOffset uint64, prev int64) (*Segment, error) {
+	seg, err := newSegment(l.Dir, baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := seg.preallocate(); err != nil {
+		_ = seg.Remove()
+		return nil, err
+	}
+	if err := seg.loadTimestamps(prev); err != nil {
+		_ = seg.Remove()
+		return nil, err
+	}
+	return seg, nil
+}
+
 func (l *Log) Close() error {
+	l.closeMu.Lock()
+	if l.closed {
+		l.closeMu.Unlock()
+		return nil
+	}
+	l.closed = true
+	if l.appends != nil {
+		close(l.appends)
+	}
+	close(l.closing)
+	l.closeMu.Unlock()
+	l.wg.Wait()
+
+	// Every segment is closed and the lock is released even if a segment fails to close, the first error is returned.
+	var closeErr error
 	for _, seg := range l.segments {
-		err := seg.Close()
-		if err != nil {
-			return err
+		if err := seg.Close(); err != nil && closeErr == nil {
+			closeErr = err
 		}
 	}
-	return nil
+	if l.lock != nil {
+		if err := l.lock.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
 }
 
+// Compact removes the segments whose records all have offsets lower than offset. The active segment is never
+// removed.
 func (l *Log) Compact(offset uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return err
+	}
 
-	if offset > l.activeSegment.nextOffset {
+	if offset > l.activeSegment.nextOffset.Load() {
 		return ErrIllegalOffsetRange
 	}
 
-	var i int
-	for i = 0; i < len(l.segments); i++ {
-		seg := l.segments[i]
-		if seg.nextOffset < offset {
-			if err := seg.Remove(); err != nil {
-				return err
-			}
-		} else {
-			break
+	// The segments before the one holding offset only hold lower offsets. The active segment holds offset at the
+	// latest, so it is never removed.
+	n := l.searchSegment(offset)
+	if n < 0 {
+		n = 0
+	}
+	return l.removeSegments(n)
+}
+
+// removeSegments removes the first n segments of the log. They are dropped from the manifest before their files are
+// removed, so the files left by a crash are removed when the log is reopened. The caller must hold the lock.
+func (l *Log) removeSegments(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if err := l.commitManifest(l.segments[n:]); err != nil {
+		return err
+	}
+	removed := l.segments[:n]
+	l.segments = l.segments[n:]
+	l.publish()
+	for _, seg := range removed {
+		if err := seg.remove(); err != nil {
+			return err
 		}
 	}
-	l.segments = l.segments[i+1:]
 	return nil
 }
@@ -1,9 +1,16 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"google.golang.org/protobuf/proto"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLogWriteAndRead(t *testing.T) {
@@ -39,6 +46,68 @@ func TestLogWriteAndRead(t *testing.T) {
 	}
 }
 
+func TestAppendRecord(t *testing.T) {
+	for _, config := range []Config{defaultConfig, {SegmentConfig: defaultConfig.SegmentConfig, Codec: RawCodec{}}} {
+		dir, err := os.MkdirTemp("", "log-test")
+		require.NoError(t, err)
+		defer func(path string) {
+			err := os.RemoveAll(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}(dir)
+
+		log, err := NewLog(dir, config)
+		require.NoError(t, err)
+
+		before := time.Now().UnixNano()
+		offset, err := log.Append([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), offset)
+		record := &log_v1.Record{
+			Value:   []byte("world"),
+			Key:     []byte("key"),
+			Headers: map[string][]byte{"content-type": []byte("text/plain")},
+			Type:    "greeting",
+		}
+		offset, err = log.AppendRecord(record)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), offset)
+		require.Equal(t, uint64(1), record.Offset)
+		require.GreaterOrEqual(t, record.Timestamp, before)
+		require.LessOrEqual(t, record.Timestamp, time.Now().UnixNano())
+		stamped := &log_v1.Record{Value: []byte("stamped"), Timestamp: 42}
+		_, err = log.AppendRecord(stamped)
+		require.NoError(t, err)
+		require.Equal(t, int64(42), stamped.Timestamp)
+		require.NoError(t, log.Close())
+
+		log, err = NewLog(dir, config)
+		require.NoError(t, err)
+		defer func(log *Log) {
+			err := log.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}(log)
+		read, err := log.ReadRecord(0)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(read.Value))
+		require.GreaterOrEqual(t, read.Timestamp, before)
+		read, err = log.ReadRecord(1)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(record, read), "%v != %v", record, read)
+		data, err := log.Read(1)
+		require.NoError(t, err)
+		require.Equal(t, "world", string(data))
+		read, err = log.ReadRecord(2)
+		require.NoError(t, err)
+		require.Equal(t, int64(42), read.Timestamp)
+		_, err = log.ReadRecord(3)
+		require.ErrorIs(t, err, ErrIllegalOffsetRange)
+	}
+}
+
 func TestSegmentMaxSize(t *testing.T) {
 	dir, err := os.MkdirTemp("", "log-test")
 	require.NoError(t, err)
@@ -86,6 +155,68 @@ func TestSegmentMaxSize(t *testing.T) {
 
 }
 
+func TestRollFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	msgs := []string{randStr(65)}
+	_, err = log.Append([]byte(msgs[0]))
+	require.NoError(t, err)
+
+	// the files of the next segment can not be created, the active segment is kept and appended to.
+	blocked := segmentFileName(dir, 1, ".index")
+	require.NoError(t, os.Mkdir(blocked, 0755))
+	_, err = log.Append([]byte(randStr(65)))
+	require.Error(t, err)
+	require.Equal(t, 1, len(log.segments))
+	require.Nil(t, log.activeSegment.store.mapping.Load())
+	msgs = append(msgs, "b")
+	offset, err := log.Append([]byte(msgs[1]))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+
+	require.NoError(t, os.Remove(blocked))
+	msgs = append(msgs, randStr(65))
+	offset, err = log.Append([]byte(msgs[2]))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	require.Equal(t, 2, len(log.segments))
+	for i, msg := range msgs {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(data))
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	for i, msg := range msgs {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(data))
+	}
+}
+
 func TestRestore(t *testing.T) {
 	config := Config{
 		SegmentConfig: SegmentConfig{
@@ -109,7 +240,7 @@ func TestRestore(t *testing.T) {
 
 	msgs := make([][]byte, 0)
 	for i := 0; i < 1024; i++ {
-		msgs = append(msgs, []byte(randStr(52)))
+		msgs = append(msgs, []byte(randStr(42)))
 	}
 
 	for i, msg := range msgs {
@@ -123,7 +254,7 @@ func TestRestore(t *testing.T) {
 	for i := 0; i < 512; i++ {
 		seg := log.segments[i]
 		require.Equal(t, seg.baseOffset, uint64(i)*2)
-		require.Equal(t, seg.nextOffset, uint64(i+1)*2)
+		require.Equal(t, seg.nextOffset.Load(), uint64(i+1)*2)
 	}
 
 	if err := log.Close(); err != nil {
@@ -143,7 +274,13 @@ func TestRestore(t *testing.T) {
 	for i := 0; i < 512; i++ {
 		seg := logN.segments[i]
 		require.Equal(t, seg.baseOffset, uint64(i)*2)
-		require.Equal(t, seg.nextOffset, uint64(i+1)*2)
+		require.Equal(t, seg.nextOffset.Load(), uint64(i+1)*2)
+	}
+	// only the active segment is preallocated, the sealed ones keep the size of their records.
+	for _, seg := range logN.segments[:len(logN.segments)-1] {
+		size, err := seg.store.Size()
+		require.NoError(t, err)
+		require.Equal(t, seg.store.size.Load(), size)
 	}
 	for i := 0; i < 1024; i++ {
 		b, err := logN.Read(uint64(i))
@@ -181,7 +318,7 @@ func TestCompact(t *testing.T) {
 
 	msgs := make([][]byte, 0)
 	for i := 0; i < 1024; i++ {
-		msgs = append(msgs, []byte(randStr(52)))
+		msgs = append(msgs, []byte(randStr(42)))
 	}
 
 	for i, msg := range msgs {
@@ -199,3 +336,607 @@ func TestCompact(t *testing.T) {
 	b, err := log.Read(512)
 	require.Equal(t, string(b), string(msgs[512]))
 }
+
+func TestLegacyFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	// write a segment in the format without store header and checksums
+	var store, index []byte
+	for i := 0; i < 3; i++ {
+		data, err := proto.Marshal(&log_v1.Record{Value: []byte(fmt.Sprintf("legacy-%d", i)), Offset: uint64(i)})
+		require.NoError(t, err)
+		index = endian.AppendUint64(index, uint64(i))
+		index = endian.AppendUint64(index, uint64(len(store)))
+		store = endian.AppendUint64(store, uint64(len(data)))
+		store = append(store, data...)
+	}
+	require.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("%012d.store", 0)), store, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("%012d.index", 0)), index, 0644))
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	offset, err := log.Append([]byte("current"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, storeFormatVersion, log.activeSegment.store.version)
+
+	for i := 0; i < 3; i++ {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("legacy-%d", i), string(b))
+	}
+	b, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "current", string(b))
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 1024,
+			MaxIndexSize:   1024,
+		},
+		GroupCommit: GroupCommitConfig{
+			MaxBatchSize: 16,
+			MaxWait:      time.Millisecond,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	const writers, records = 8, 32
+	offsets := make([][]uint64, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				offset, err := log.Append([]byte(fmt.Sprintf("%d-%d", w, i)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				offsets[w] = append(offsets[w], offset)
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.Greater(t, len(log.segments), 1)
+	require.NoError(t, log.Close())
+	_, err = log.Append([]byte("closed"))
+	require.ErrorIs(t, err, ErrLogClosed)
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	seen := make(map[uint64]bool)
+	for w := range offsets {
+		require.Len(t, offsets[w], records)
+		for i, offset := range offsets[w] {
+			require.False(t, seen[offset])
+			seen[offset] = true
+			b, err := log.Read(offset)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("%d-%d", w, i), string(b))
+		}
+	}
+	require.Equal(t, uint64(writers*records), log.activeSegment.nextOffset.Load())
+}
+
+func benchmarkAppendParallel(b *testing.B, config Config) {
+	dir, err := os.MkdirTemp("", "log-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+
+	msg := []byte(randStr(100))
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := log.Append(msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkLog_AppendParallel(b *testing.B) {
+	segmentConfig := SegmentConfig{
+		MaxSegmentSize: 1 << 24,
+		MaxIndexSize:   1 << 22,
+	}
+	b.Run("sync-every-append", func(b *testing.B) {
+		benchmarkAppendParallel(b, Config{SegmentConfig: segmentConfig})
+	})
+	b.Run("group-commit", func(b *testing.B) {
+		benchmarkAppendParallel(b, Config{
+			SegmentConfig: segmentConfig,
+			GroupCommit: GroupCommitConfig{
+				MaxBatchSize: 128,
+			},
+		})
+	})
+}
+
+func TestAppendBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	_, _, err = log.AppendBatch(nil)
+	require.ErrorIs(t, err, ErrEmptyBatch)
+
+	msgs := []string{randStr(42), randStr(42), randStr(42)}
+	offset, err := log.Append([]byte(msgs[0]))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	// the batch does not fit in the active segment, so it goes to a new one as a whole
+	first, last, err := log.AppendBatch([][]byte{[]byte(msgs[1]), []byte(msgs[2])})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(2), last)
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+
+	_, _, err = log.AppendBatch([][]byte{[]byte(randStr(42)), []byte(randStr(42)), []byte(randStr(42))})
+	require.ErrorIs(t, err, ErrExceededMaxSegmentSize)
+
+	for i, msg := range msgs {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
+
+func TestLogMetadata(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	start := time.Now()
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	_, err = log.LowestOffset()
+	require.ErrorIs(t, err, ErrEmptyLog)
+	_, err = log.HighestOffset()
+	require.ErrorIs(t, err, ErrEmptyLog)
+	require.Zero(t, log.Len())
+	require.Zero(t, log.SizeBytes())
+
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact(4))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), highest)
+	require.Equal(t, uint64(12), log.Len())
+
+	infos, err := log.Segments()
+	require.NoError(t, err)
+	require.Equal(t, 6, len(infos))
+	var size uint64
+	for i, info := range infos {
+		require.Equal(t, uint64(4+2*i), info.BaseOffset)
+		require.Equal(t, info.BaseOffset+2, info.NextOffset)
+		require.Equal(t, path.Join(dir, fmt.Sprintf("%012d.store", info.BaseOffset)), info.StoreFileName)
+		require.Equal(t, path.Join(dir, fmt.Sprintf("%012d.index", info.BaseOffset)), info.IndexFileName)
+		require.False(t, info.Created.Before(start.Truncate(time.Second)))
+		require.False(t, info.Modified.Before(info.Created.Truncate(time.Second)))
+		size += info.Size
+	}
+	require.Equal(t, size, log.SizeBytes())
+
+	require.NoError(t, log.Truncate(10))
+	highest, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	require.Equal(t, uint64(6), log.Len())
+}
+
+func TestLogMetadataConcurrent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < 256; i++ {
+			if _, err := log.Append([]byte(randStr(42))); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%16 != 0 {
+				continue
+			}
+			if err := log.Compact(i); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 256; i++ {
+		infos, err := log.Segments()
+		require.NoError(t, err)
+		for j := 1; j < len(infos); j++ {
+			require.Equal(t, infos[j-1].NextOffset, infos[j].BaseOffset)
+		}
+		if lowest, err := log.LowestOffset(); err == nil {
+			require.LessOrEqual(t, lowest, uint64(256))
+		}
+	}
+	wg.Wait()
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(255), highest)
+	require.Equal(t, highest-lowest+1, log.Len())
+}
+
+// fakeSegment returns a segment which is not backed by files.
+func fakeSegment(baseOffset uint64, nextOffset uint64) *Segment {
+	seg := &Segment{baseOffset: baseOffset}
+	seg.nextOffset.Store(nextOffset)
+	return seg
+}
+
+func TestFindSegment(t *testing.T) {
+	log := &Log{}
+	for base := uint64(10); base < 100; base += 10 {
+		log.segments = append(log.segments, fakeSegment(base, base+10))
+	}
+	// the active segment is empty
+	log.segments = append(log.segments, fakeSegment(100, 100))
+	log.activeSegment = log.segments[len(log.segments)-1]
+
+	tests := []struct {
+		offset uint64
+		search int
+		base   uint64
+		found  bool
+	}{
+		{offset: 0, search: -1},
+		{offset: 9, search: -1},
+		{offset: 10, search: 0, base: 10, found: true},
+		{offset: 19, search: 0, base: 10, found: true},
+		{offset: 20, search: 1, base: 20, found: true},
+		{offset: 99, search: 8, base: 90, found: true},
+		{offset: 100, search: 9},
+		{offset: 1000, search: 9},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("offset %d", tt.offset), func(t *testing.T) {
+			require.Equal(t, tt.search, log.searchSegment(tt.offset))
+			seg := log.findSegment(tt.offset)
+			if !tt.found {
+				require.Nil(t, seg)
+				return
+			}
+			require.NotNil(t, seg)
+			require.Equal(t, tt.base, seg.baseOffset)
+		})
+	}
+}
+
+// BenchmarkLog_FindSegment compares the binary search of the segment holding an offset with a linear scan. The
+// segments are not backed by files, 10k segments would need 20k open files.
+func BenchmarkLog_FindSegment(b *testing.B) {
+	const segments = 10000
+	const records = 16
+	log := &Log{}
+	for i := uint64(0); i < segments; i++ {
+		log.segments = append(log.segments, fakeSegment(i*records, (i+1)*records))
+	}
+	log.activeSegment = log.segments[segments-1]
+
+	b.Run("linear", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			offset := uint64(n*7919) % (segments * records)
+			var seg *Segment
+			for _, s := range log.segments {
+				if offset >= s.baseOffset && offset < s.nextOffset.Load() {
+					seg = s
+					break
+				}
+			}
+			if seg == nil {
+				b.Fatal("segment not found")
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			offset := uint64(n*7919) % (segments * records)
+			if log.findSegment(offset) == nil {
+				b.Fatal("segment not found")
+			}
+		}
+	})
+}
+
+func BenchmarkLog_ReadSegments(b *testing.B) {
+	dir, err := os.MkdirTemp("", "log-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+		Sync: SyncConfig{Policy: SyncNever},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+	// two records per segment, half the segments of BenchmarkLog_FindSegment to stay within the open files limit.
+	const records = 10000
+	for i := 0; i < records; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(b, err)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := log.Read(uint64(n*7919) % records); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 256,
+			MaxIndexSize:   1024,
+		},
+		Sync: SyncConfig{Policy: SyncNever},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	const records = 2000
+	value := func(offset uint64) string {
+		return fmt.Sprintf("record-%08d", offset)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := uint64(0); i < records; i++ {
+			if _, err := log.Append([]byte(value(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); ; i += 100 {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := log.Compact(i); err != nil && !errors.Is(err, ErrIllegalOffsetRange) {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// both offsets are taken from the same view, a compaction in between could make lowest greater.
+				segments := log.segmentsView()
+				if length(segments) == 0 {
+					continue
+				}
+				lowest := segments[0].baseOffset
+				highest := segments[len(segments)-1].nextOffset.Load() - 1
+				offset := lowest + uint64(n*(r+7))%(highest-lowest+1)
+				data, err := log.Read(offset)
+				// the record may be compacted since the offsets were read
+				if errors.Is(err, ErrIllegalOffsetRange) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(data) != value(offset) {
+					t.Errorf("offset %d: got %s", offset, data)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(records-1), highest)
+	data, err := log.Read(highest)
+	require.NoError(t, err)
+	require.Equal(t, value(highest), string(data))
+}
+
+func TestReadDoesNotBlockAppend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	_, err = log.Append([]byte(randStr(42)))
+	require.NoError(t, err)
+
+	// a read in progress on the active segment
+	seg := log.activeSegment
+	seg.readMu.RLock()
+	appended := make(chan error)
+	go func() {
+		for i := 0; i < 4; i++ {
+			if _, err := log.Append([]byte(randStr(42))); err != nil {
+				appended <- err
+				return
+			}
+		}
+		_, err := log.Read(4)
+		appended <- err
+	}()
+	select {
+	case err := <-appended:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("append blocked by a read")
+	}
+	seg.readMu.RUnlock()
+	require.Equal(t, 3, len(log.segments))
+}
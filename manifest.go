@@ -0,0 +1,211 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// manifestFileName is the name of the file listing the segments of the log, and manifestTempFileName the name a
+	// new manifest is written to before it replaces the previous one.
+	manifestFileName     = "MANIFEST"
+	manifestTempFileName = "MANIFEST.tmp"
+
+	// manifestV1 lists the base offsets of the segments.
+	manifestV1 uint32 = 1
+	// manifestV2 records the base offset of the log before the segments, so it records the offset an empty log starts
+	// from.
+	manifestV2 uint32 = 2
+
+	manifestVersion = manifestV2
+)
+
+var (
+	manifestMagic = []byte("YAWM")
+
+	// segmentFileExts are the extensions of the files of a segment.
+	segmentFileExts = []string{".store", ".index", ".timeindex"}
+)
+
+// manifest is the content of the manifest file.
+type manifest struct {
+	// baseOffset is the base offset of the log: the one of its first segment, or the one its first segment is created
+	// with if it has none.
+	baseOffset uint64
+	// segments are the base offsets of the segments, in increasing order.
+	segments []uint64
+}
+
+// segmentFileName returns the name of the file of the segment with baseOffset which has the extension ext.
+func segmentFileName(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%012d%s", baseOffset, ext))
+}
+
+// parseSegmentFileName returns the base offset and the extension of a file of a segment, and whether name is one.
+func parseSegmentFileName(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	for _, segmentExt := range segmentFileExts {
+		if ext != segmentExt {
+			continue
+		}
+		baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			return 0, "", false
+		}
+		return baseOffset, ext, true
+	}
+	return 0, "", false
+}
+
+// writeManifest replaces the manifest of the log in dir by m. It is written to a temporary file which is synced and
+// renamed over the previous manifest, so a crash leaves either of them. The manifest is the magic, the version, the
+// base offset of the log, the number of segments and their base offsets, followed by a CRC32C checksum.
+func writeManifest(dir string, m manifest) error {
+	buf := make([]byte, 0, magicWidth+versionWidth+2*offWidth+len(m.segments)*offWidth+crcWidth)
+	buf = append(buf, manifestMagic...)
+	buf = endian.AppendUint32(buf, manifestVersion)
+	buf = endian.AppendUint64(buf, m.baseOffset)
+	buf = endian.AppendUint64(buf, uint64(len(m.segments)))
+	for _, baseOffset := range m.segments {
+		buf = endian.AppendUint64(buf, baseOffset)
+	}
+	buf = endian.AppendUint32(buf, checksum(buf))
+
+	name := path.Join(dir, manifestTempFileName)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name, path.Join(dir, manifestFileName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readManifest returns the manifest of the log in dir, and whether there is one. ErrCorruptManifest is returned if
+// the manifest does not match its checksum.
+func readManifest(dir string) (manifest, bool, error) {
+	buf, err := os.ReadFile(path.Join(dir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{}, false, nil
+	}
+	if err != nil {
+		return manifest{}, false, err
+	}
+	if len(buf) < magicWidth+versionWidth+crcWidth || !bytes.Equal(buf[:magicWidth], manifestMagic) {
+		return manifest{}, false, ErrCorruptManifest
+	}
+	body, crc := buf[:len(buf)-crcWidth], endian.Uint32(buf[len(buf)-crcWidth:])
+	if checksum(body) != crc {
+		return manifest{}, false, ErrCorruptManifest
+	}
+	var m manifest
+	version := endian.Uint32(body[magicWidth : magicWidth+versionWidth])
+	body = body[magicWidth+versionWidth:]
+	switch version {
+	case manifestV1:
+	case manifestV2:
+		if len(body) < offWidth {
+			return manifest{}, false, ErrCorruptManifest
+		}
+		m.baseOffset, body = endian.Uint64(body[:offWidth]), body[offWidth:]
+	default:
+		return manifest{}, false, ErrCorruptManifest
+	}
+	if len(body) < offWidth || (len(body)-offWidth)%offWidth != 0 {
+		return manifest{}, false, ErrCorruptManifest
+	}
+	count, body := endian.Uint64(body[:offWidth]), body[offWidth:]
+	if count != uint64(len(body)/offWidth) {
+		return manifest{}, false, ErrCorruptManifest
+	}
+	m.segments = make([]uint64, 0, count)
+	for pos := 0; pos < len(body); pos += offWidth {
+		baseOffset := endian.Uint64(body[pos : pos+offWidth])
+		if n := len(m.segments); n > 0 && baseOffset <= m.segments[n-1] {
+			return manifest{}, false, ErrCorruptManifest
+		}
+		m.segments = append(m.segments, baseOffset)
+	}
+	if version == manifestV1 && len(m.segments) > 0 {
+		m.baseOffset = m.segments[0]
+	}
+	return m, true, nil
+}
+
+// scanSegments returns the base offsets of the segments whose store files are in dir, in increasing order. It finds
+// the segments of a log written before the manifest.
+func scanSegments(dir string) ([]uint64, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	baseOffsets := make([]uint64, 0)
+	for _, entry := range dirEntries {
+		if baseOffset, ext, ok := parseSegmentFileName(entry.Name()); ok && ext == ".store" {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// collectGarbage removes the files of the segments which are not listed in baseOffsets, such as the segments being
+// created or removed when the process died, and a manifest which was not renamed yet.
+func collectGarbage(dir string, baseOffsets []uint64) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[uint64]bool, len(baseOffsets))
+	for _, baseOffset := range baseOffsets {
+		listed[baseOffset] = true
+	}
+	removed := false
+	for _, entry := range dirEntries {
+		baseOffset, _, ok := parseSegmentFileName(entry.Name())
+		if ok && listed[baseOffset] || !ok && entry.Name() != manifestTempFileName {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// commitManifest writes the manifest listing segments. It is written once the files of a new segment are created,
+// and before the files of a removed segment are removed. The caller must hold the lock.
+func (l *Log) commitManifest(segments []*Segment) error {
+	m := manifest{segments: make([]uint64, 0, len(segments))}
+	for _, seg := range segments {
+		m.segments = append(m.segments, seg.baseOffset)
+	}
+	if len(m.segments) > 0 {
+		m.baseOffset = m.segments[0]
+	}
+	return writeManifest(l.Dir, m)
+}
@@ -0,0 +1,140 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manifest-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	_, ok, err := readManifest(dir)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, writeManifest(dir, manifest{baseOffset: 0, segments: []uint64{0, 16, 1 << 40}}))
+	m, ok, err := readManifest(dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), m.baseOffset)
+	require.Equal(t, []uint64{0, 16, 1 << 40}, m.segments)
+	_, err = os.Stat(path.Join(dir, manifestTempFileName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	name := path.Join(dir, manifestFileName)
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	data[len(data)-crcWidth-1] ^= 0xff
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	_, _, err = readManifest(dir)
+	require.ErrorIs(t, err, ErrCorruptManifest)
+	require.NoError(t, os.WriteFile(name, data[:magicWidth+versionWidth], 0644))
+	_, _, err = readManifest(dir)
+	require.ErrorIs(t, err, ErrCorruptManifest)
+
+	// a manifest of the first version does not record the base offset of the log.
+	data = append(append([]byte{}, manifestMagic...), endian.AppendUint32(nil, manifestV1)...)
+	data = endian.AppendUint64(data, 2)
+	data = endian.AppendUint64(endian.AppendUint64(data, 16), 32)
+	data = endian.AppendUint32(data, checksum(data))
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	m, ok, err = readManifest(dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, manifest{baseOffset: 16, segments: []uint64{16, 32}}, m)
+
+	for name, want := range map[string]bool{
+		"000000000016.store":     true,
+		"000000000016.timeindex": true,
+		"16.index":               true,
+		"000000000016.store.tmp": false,
+		"store.store":            false,
+		".store":                 false,
+		"LOCK":                   false,
+	} {
+		_, _, ok := parseSegmentFileName(name)
+		require.Equal(t, want, ok, name)
+	}
+}
+
+func TestLogManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manifest-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	requireManifest := func(log *Log) {
+		t.Helper()
+		m, ok, err := readManifest(dir)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, log.segments[0].baseOffset, m.baseOffset)
+		require.Len(t, m.segments, len(log.segments))
+		for i, seg := range log.segments {
+			require.Equal(t, seg.baseOffset, m.segments[i])
+		}
+	}
+	requireManifest(log)
+	require.NoError(t, log.Compact(log.segments[1].baseOffset))
+	requireManifest(log)
+	require.NoError(t, log.Truncate(log.segments[1].baseOffset+1))
+	requireManifest(log)
+	next := log.activeSegment.nextOffset.Load()
+	require.NoError(t, log.Close())
+
+	// the files of a segment the process died creating, and a manifest it did not rename, are removed. The other files
+	// are left alone.
+	garbage := []string{
+		segmentFileName(dir, next, ".store"),
+		segmentFileName(dir, next, ".index"),
+		segmentFileName(dir, 0, ".timeindex"),
+		path.Join(dir, manifestTempFileName),
+	}
+	for _, name := range append(garbage, path.Join(dir, "notes.txt")) {
+		require.NoError(t, os.WriteFile(name, []byte("garbage"), 0644))
+	}
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	requireManifest(log)
+	require.Equal(t, next, log.activeSegment.nextOffset.Load())
+	for _, name := range garbage {
+		_, err = os.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	_, err = os.Stat(path.Join(dir, "notes.txt"))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// a log written before the manifest is found from its files, and gets one.
+	require.NoError(t, os.Remove(path.Join(dir, manifestFileName)))
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	requireManifest(log)
+	require.Equal(t, next, log.activeSegment.nextOffset.Load())
+}
@@ -0,0 +1,276 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"io"
+)
+
+const (
+	readerBufferSize = 64 * 1024
+
+	// segmentHeaderSize is the size of the segment header written by Read before the store header of the segment:
+	// the magic, the base offset of the segment, the position of its first frame in the stream and the size of the
+	// store header.
+	segmentHeaderSize = magicWidth + baseOffsetWidth + posWidth + lenWidth
+)
+
+var (
+	// segmentMagic marks a segment header in the stream of Read. A frame starts with its 8 bytes big endian length,
+	// which can never be as large as the magic.
+	segmentMagic = []byte("YAWS")
+)
+
+// Reader reads a log sequentially from an offset, across segment boundaries. It streams the frames of the store
+// files with buffered I/O instead of looking up every record in the index. Records appended after the Reader reached
+// the end of the log are returned by the following calls.
+//
+// Next and Read consume the same stream, so Next must not be called once Read stopped in the middle of a frame. A
+// compressed frame is consumed as a whole by the first call to Next which returns one of its records.
+type Reader struct {
+	log *Log
+	seg *Segment
+	// offset is the offset of the next record.
+	offset uint64
+	// pos is the position of the next byte of the stream in the store file of seg, and end is the end of the section
+	// of the store file buffered by r.
+	pos uint64
+	end uint64
+	r   *bufio.Reader
+	// header is the part of the segment header of seg not read yet by Read, and started is set once it is built.
+	header  []byte
+	started bool
+	// pending are the encoded records of the compressed frame read last which are not returned yet.
+	pending [][]byte
+}
+
+// NewReader returns a Reader which reads the log from offset. The offset of the next record to be appended is
+// accepted, then the Reader starts with the records appended after NewReader returns.
+func (l *Log) NewReader(offset uint64) (*Reader, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return nil, err
+	}
+
+	seg := l.findSegment(offset)
+	if seg == nil && offset == l.activeSegment.nextOffset.Load() {
+		seg = l.activeSegment
+	}
+	if seg == nil {
+		return nil, ErrIllegalOffsetRange
+	}
+	seg.acquire()
+
+	seg.mu.Lock()
+	pos := seg.store.logicalSize()
+	if offset < seg.nextOffset.Load() {
+		_, p, err := seg.index.Read(offset - seg.baseOffset)
+		if err != nil {
+			seg.mu.Unlock()
+			_ = seg.release()
+			return nil, err
+		}
+		pos = p
+	}
+	seg.mu.Unlock()
+
+	r := &Reader{
+		log:    l,
+		offset: offset,
+		r:      bufio.NewReaderSize(nil, readerBufferSize),
+	}
+	r.reset(seg, pos, seg.store.logicalSize())
+	return r, nil
+}
+
+// Close releases the segment the Reader is reading. A segment is not deleted by retention while a Reader uses it, and
+// it is not closed before the Reader releases it if it is compacted, so a Reader must be closed when it is no longer
+// used. Only the segment being read is kept: once it is read to the end, the Reader skips the segments compacted
+// meanwhile and continues with the oldest record left.
+func (r *Reader) Close() error {
+	if r.seg == nil {
+		return nil
+	}
+	err := r.seg.release()
+	r.seg = nil
+	return err
+}
+
+// Next returns the next record of the log. It returns io.EOF at the end of the log, and a CorruptRecordError if the
+// frame of the record is corrupt.
+func (r *Reader) Next() (*log_v1.Record, error) {
+	for {
+		if len(r.pending) == 0 {
+			if err := r.next(); err != nil {
+				return nil, err
+			}
+		}
+		data := r.pending[0]
+		r.pending = r.pending[1:]
+
+		record := new(log_v1.Record)
+		if err := r.seg.codec.Decode(data, record); err != nil {
+			return nil, err
+		}
+		// A Reader created for a record in the middle of a compressed frame starts with the first record of the frame.
+		if record.Offset < r.offset {
+			continue
+		}
+		r.offset = record.Offset + 1
+		return record, nil
+	}
+}
+
+// next reads the next frame of the stream and queues its records in pending.
+func (r *Reader) next() error {
+	if err := r.fill(); err != nil {
+		return err
+	}
+
+	store := r.seg.store
+	pos := r.pos
+	header := make([]byte, store.frameHeaderSize())
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return r.corrupt(pos, err)
+	}
+	r.pos += uint64(len(header))
+	length := endian.Uint64(header[:lenWidth])
+	if length > r.end-r.pos {
+		return r.corrupt(pos, ErrCorruptRecord)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return r.corrupt(pos, err)
+	}
+	r.pos += length
+	attrs, err := store.checkFrame(header, data)
+	if err != nil {
+		return r.corrupt(pos, err)
+	}
+	if data, err = store.decrypt(pos, data); err != nil {
+		return r.corrupt(pos, err)
+	}
+
+	records, err := frameRecords(frame{attrs: attrs, data: data})
+	if err != nil {
+		return r.corrupt(pos, err)
+	}
+	r.pending = records
+	return nil
+}
+
+// Read reads the raw frames of the store files into p, so the log can be copied or shipped. The frames of every
+// segment are preceded by a segment header: the magic "YAWS", the base offset of the segment, the position of the
+// first frame in the store file and the size of the store header as 8 bytes big endian integers, followed by the store
+// header, which is empty for the store files without one. The frames are in the format of the store files they are
+// read from, so a segment read from its first record is rebuilt by writing its store header followed by its frames to
+// a store file named after its base offset. It returns io.EOF at the end of the log.
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	if !r.started {
+		header, err := r.segmentHeader()
+		if err != nil {
+			return 0, err
+		}
+		r.header = header
+		r.started = true
+	}
+	if len(r.header) > 0 {
+		n := copy(p, r.header)
+		r.header = r.header[n:]
+		return n, nil
+	}
+	n, err := r.r.Read(p)
+	r.pos += uint64(n)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// segmentHeader returns the segment header which precedes the frames of seg read from pos in the stream of Read.
+func (r *Reader) segmentHeader() ([]byte, error) {
+	size := r.seg.store.headerSize()
+	header := make([]byte, segmentHeaderSize+size)
+	copy(header, segmentMagic)
+	endian.PutUint64(header[magicWidth:], r.seg.baseOffset)
+	endian.PutUint64(header[magicWidth+baseOffsetWidth:], r.pos)
+	endian.PutUint64(header[magicWidth+baseOffsetWidth+posWidth:], size)
+	if _, err := r.seg.store.ReadAt(header[segmentHeaderSize:], 0); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// fill makes sure there is something left to read in the buffered section. It extends the section to the records
+// appended to the segment since, and moves to the next segment once the current one is read to the end. It returns
+// io.EOF at the end of the log.
+func (r *Reader) fill() error {
+	if r.seg == nil {
+		return ErrReaderClosed
+	}
+	for r.pos == r.end {
+		if size := r.seg.store.logicalSize(); size > r.end {
+			r.reset(r.seg, r.pos, size)
+			return nil
+		}
+		next := r.log.segmentAfter(r.seg)
+		if next == nil {
+			return io.EOF
+		}
+		// seg was the active segment and got records appended right before the next segment was rolled.
+		if size := r.seg.store.logicalSize(); size > r.end {
+			r.reset(r.seg, r.pos, size)
+			return next.release()
+		}
+		r.reset(next, next.store.headerSize(), next.store.logicalSize())
+		r.offset = next.baseOffset
+	}
+	return nil
+}
+
+// reset moves the Reader to the section of the store file of seg from pos to end. The Reader takes over the
+// reference to seg acquired by the caller, and releases the segment it was reading.
+func (r *Reader) reset(seg *Segment, pos uint64, end uint64) {
+	if r.seg != seg {
+		if r.seg != nil {
+			_ = r.seg.release()
+		}
+		r.seg = seg
+		r.header = nil
+		r.started = false
+	}
+	r.pos = pos
+	r.end = end
+	r.r.Reset(io.NewSectionReader(seg.store.File, int64(pos), int64(end-pos)))
+}
+
+// corrupt converts the error of reading the frame at pos to a CorruptRecordError if the frame is partial or corrupt.
+func (r *Reader) corrupt(pos uint64, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorruptRecord) {
+		return &CorruptRecordError{
+			BaseOffset: r.seg.baseOffset,
+			Offset:     r.offset,
+			Pos:        pos,
+		}
+	}
+	return err
+}
+
+// segmentAfter acquires and returns the segment following seg, or returns nil if seg is the active segment. If the
+// segments following seg were deleted meanwhile, it returns the oldest segment left after them.
+func (l *Log) segmentAfter(seg *Segment) *Segment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if s.baseOffset > seg.baseOffset {
+			s.acquire()
+			return s
+		}
+	}
+	return nil
+}
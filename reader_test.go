@@ -0,0 +1,248 @@
+package log
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReaderNext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reader-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	msgs := make([]string, 0)
+	for i := 0; i < 16; i++ {
+		msgs = append(msgs, randStr(42))
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, len(log.segments))
+
+	for _, from := range []uint64{0, 5, 15} {
+		r, err := log.NewReader(from)
+		require.NoError(t, err)
+		for i := from; i < uint64(len(msgs)); i++ {
+			record, err := r.Next()
+			require.NoError(t, err)
+			require.Equal(t, i, record.Offset)
+			require.Equal(t, msgs[i], string(record.Value))
+		}
+		_, err = r.Next()
+		require.ErrorIs(t, err, io.EOF)
+	}
+
+	_, err = log.NewReader(17)
+	require.ErrorIs(t, err, ErrIllegalOffsetRange)
+
+	// a reader at the end of the log returns the records appended later, in the active segment and after a roll
+	r, err := log.NewReader(16)
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+	for i := 16; i < 19; i++ {
+		msgs = append(msgs, randStr(42))
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+	for i := 16; i < 19; i++ {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, msgs[i], string(record.Value))
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderRead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reader-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+
+	var frames []byte
+	for _, seg := range log.segments {
+		b, err := os.ReadFile(seg.StoreFileName())
+		require.NoError(t, err)
+		frames = append(frames, segmentMagic...)
+		frames = endian.AppendUint64(frames, seg.baseOffset)
+		frames = endian.AppendUint64(frames, storeHeaderSize)
+		frames = endian.AppendUint64(frames, storeHeaderSize)
+		frames = append(frames, b[:seg.store.size.Load()]...)
+	}
+
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(frames, b))
+}
+
+func TestReaderReadRebuild(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reader-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	require.NoError(t, os.Mkdir(src, 0755))
+	require.NoError(t, os.Mkdir(dst, 0755))
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(src, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	var values [][]byte
+	for i := 0; i < 16; i++ {
+		value := []byte(randStr(42))
+		_, err := log.Append(value)
+		require.NoError(t, err)
+		values = append(values, value)
+	}
+
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// Every segment header is followed by the store header and the frames up to the next segment header.
+	for len(b) > 0 {
+		require.True(t, bytes.HasPrefix(b, segmentMagic))
+		baseOffset := endian.Uint64(b[magicWidth:])
+		pos := endian.Uint64(b[magicWidth+baseOffsetWidth:])
+		size := endian.Uint64(b[magicWidth+baseOffsetWidth+posWidth:])
+		require.Equal(t, size, pos)
+		b = b[segmentHeaderSize:]
+		store := &Store{version: endian.Uint32(b[magicWidth:])}
+		end := size
+		for end < uint64(len(b)) && !bytes.HasPrefix(b[end:], segmentMagic) {
+			end += store.frameHeaderSize() + endian.Uint64(b[end:])
+		}
+		err := os.WriteFile(segmentFileName(dst, baseOffset, ".store"), b[:end], 0644)
+		require.NoError(t, err)
+		b = b[end:]
+	}
+
+	rebuilt, err := NewLog(dst, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(rebuilt)
+	require.Equal(t, len(log.segments), len(rebuilt.segments))
+	for i, value := range values {
+		b, err := rebuilt.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, value, b)
+	}
+}
+
+func BenchmarkLog_Replay(b *testing.B) {
+	dir, err := os.MkdirTemp("", "reader-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 1 << 20,
+			MaxIndexSize:   1 << 20,
+		},
+		Sync: SyncConfig{Policy: SyncNever},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+	const records = 10000
+	for i := 0; i < records; i++ {
+		_, err := log.Append([]byte(randStr(100)))
+		require.NoError(b, err)
+	}
+
+	b.Run("read", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for i := uint64(0); i < records; i++ {
+				if _, err := log.Read(i); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("reader", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			r, err := log.NewReader(0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := uint64(0); i < records; i++ {
+				if _, err := r.Next(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
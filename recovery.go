@@ -0,0 +1,281 @@
+package log
+
+import (
+	"bytes"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+)
+
+// RecoveryReport describes what the recovery of a segment repaired after the log was reopened.
+type RecoveryReport struct {
+	// BaseOffset is the base offset of the recovered segment.
+	BaseOffset uint64
+	// RebuiltIndexEntries is the number of index entries rebuilt for complete frames the index did not point to.
+	RebuiltIndexEntries uint64
+	// DroppedIndexEntries is the number of index entries dropped because they did not point to a complete frame.
+	DroppedIndexEntries uint64
+	// TruncatedBytes is the number of bytes of partial frames cut from the tail of the store file.
+	TruncatedBytes uint64
+}
+
+// Repaired reports whether the recovery changed the segment.
+func (r *RecoveryReport) Repaired() bool {
+	return r.RebuiltIndexEntries > 0 || r.DroppedIndexEntries > 0 || r.TruncatedBytes > 0
+}
+
+// recover brings the index and the store of the segment back in line after a crash. The store is written before the
+// index, so a crash may leave complete frames the index does not point to, a partial frame or batch at the tail of
+// the store, and index slots which are garbage because the index file is only truncated to its real size on close.
+//
+// recover keeps the index entries up to the last one pointing to the complete last frame of a batch, rebuilds the
+// entries of the complete batches after it and truncates the store after the last complete batch. The entries of
+// the last compressed frame the index points to are rebuilt as well.
+func (s *Segment) recover() (*RecoveryReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.index.copyEntries()
+	pos := s.store.headerSize()
+	var valid uint64
+	for i := s.index.entries(); i > 0; i-- {
+		off, p, err := s.index.Read(i - 1)
+		if err != nil {
+			return nil, err
+		}
+		if off != i-1 {
+			continue
+		}
+		f, err := s.store.readFrame(p)
+		if err != nil || f.attrs&attrBatchContinue != 0 {
+			continue
+		}
+		if f.compression() != CompressionNone {
+			// The entries of the records after off in a compressed frame may be missing, the entries of the frame are
+			// rebuilt.
+			first, _, _, err := batchHeader(f.data)
+			if err != nil || first < s.baseOffset || first > s.baseOffset+off {
+				continue
+			}
+			valid, pos = first-s.baseOffset, p
+			break
+		}
+		valid, pos = i, f.next
+		break
+	}
+	s.index.truncate(valid)
+
+	end, err := s.reindex(pos, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.repaired(old, end)
+}
+
+// bound finds the records of a segment of a read-only log without changing its files, like recover: they are the
+// records up to the last index entry pointing to the complete last frame of a batch. The frames the writer of the log
+// did not write the index entries of yet, and a partial frame it is writing, are left out.
+func (s *Segment) bound() {
+	var valid uint64
+	end := s.store.headerSize()
+	for i := s.index.entries(); i > 0; i-- {
+		off, p, err := s.index.Read(i - 1)
+		if err != nil || off != i-1 {
+			continue
+		}
+		f, err := s.store.readFrame(p)
+		if err != nil || f.attrs&attrBatchContinue != 0 {
+			continue
+		}
+		n := i
+		if f.compression() != CompressionNone {
+			first, count, _, err := batchHeader(f.data)
+			if err != nil || first < s.baseOffset || first > s.baseOffset+off {
+				continue
+			}
+			n = first - s.baseOffset + count
+		}
+		valid = n
+		// The index is a copy of the index file, the missing entries of the records of a compressed frame are
+		// completed in memory.
+		s.index.truncate(i)
+		for j := i; j < valid; j++ {
+			if err := s.index.write(j, p); err != nil {
+				valid = j
+				break
+			}
+		}
+		end = f.next
+		break
+	}
+	if valid == 0 {
+		s.index.truncate(0)
+	}
+	s.store.size.Store(end)
+	s.nextOffset.Store(s.baseOffset + valid)
+}
+
+// rebuildIndex regenerates the index of the segment from the store file. Every frame is decoded to confirm the
+// offsets of its records. The rebuild stops at the first frame which is partial, corrupt or does not carry the
+// expected offset, or at the first frame of an incomplete batch.
+//
+// Only the tail of the active segment is written by appends which a crash may tear, so the store is only truncated
+// there if tail is set. The records of a sealed segment are followed by the ones of the next segment, a frame which
+// stops the rebuild before its end is reported as a CorruptRecordError and the segment is left as it was.
+func (s *Segment) rebuildIndex(tail bool) (*RecoveryReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	old := s.index.copyEntries()
+	s.index.truncate(0)
+
+	end, err := s.reindex(s.store.headerSize(), true)
+	if err != nil {
+		return nil, err
+	}
+	if !tail && end < s.store.logicalSize() {
+		dataEnd, err := s.store.dataEnd(end)
+		if err != nil {
+			return nil, err
+		}
+		if dataEnd > end {
+			offset := s.baseOffset + s.index.entries()
+			s.index.restore(old)
+			if err := s.index.Sync(); err != nil {
+				return nil, err
+			}
+			return nil, &CorruptRecordError{BaseOffset: s.baseOffset, Offset: offset, Pos: end}
+		}
+	}
+	return s.repaired(old, end)
+}
+
+// reindex writes the index entries of the complete batches of frames from pos and returns the position after the
+// last one. The frames are decoded to confirm the offsets of their records if verify is set. The caller must hold
+// the lock.
+func (s *Segment) reindex(pos uint64, verify bool) (uint64, error) {
+	end := pos
+	batch := make([]uint64, 0, 1)
+	_, err := s.store.scan(pos, func(f frame) error {
+		off := s.index.size/entWidth + uint64(len(batch))
+		count := uint64(1)
+		if f.compression() != CompressionNone {
+			first, n, _, err := batchHeader(f.data)
+			if err != nil || first != s.baseOffset+off {
+				return errStopScan
+			}
+			count = n
+		}
+		if verify {
+			records, err := frameRecords(f)
+			if err != nil || uint64(len(records)) != count {
+				return errStopScan
+			}
+			for i, data := range records {
+				record := new(log_v1.Record)
+				if err := s.codec.Decode(data, record); err != nil {
+					return errStopScan
+				}
+				if record.Offset != s.baseOffset+off+uint64(i) {
+					return errStopScan
+				}
+			}
+		}
+		for i := uint64(0); i < count; i++ {
+			batch = append(batch, f.pos)
+		}
+		if f.attrs&attrBatchContinue != 0 {
+			return nil
+		}
+		for _, p := range batch {
+			if err := s.index.write(s.index.size/entWidth, p); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		end = f.next
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.index.Sync(); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+// repaired truncates the store after end, which is the last complete frame, and reports the difference between the
+// old and the current index entries. The zeroed space of a preallocated store file is not reported as truncated.
+// The caller must hold the lock.
+func (s *Segment) repaired(old []byte, end uint64) (*RecoveryReport, error) {
+	report := &RecoveryReport{BaseOffset: s.baseOffset}
+
+	entries := s.index.entries()
+	for i := uint64(0); i < entries; i++ {
+		entry := s.index.mmap[i*entWidth : (i+1)*entWidth]
+		if (i+1)*entWidth > uint64(len(old)) || !bytes.Equal(old[i*entWidth:(i+1)*entWidth], entry) {
+			report.RebuiltIndexEntries++
+		}
+	}
+	for i := entries; (i+1)*entWidth <= uint64(len(old)); i++ {
+		if !bytes.Equal(old[i*entWidth:(i+1)*entWidth], make([]byte, entWidth)) {
+			report.DroppedIndexEntries++
+		}
+	}
+
+	if end < s.store.logicalSize() {
+		dataEnd, err := s.store.dataEnd(end)
+		if err != nil {
+			return nil, err
+		}
+		report.TruncatedBytes = dataEnd - end
+		if err := s.store.truncate(end); err != nil {
+			return nil, err
+		}
+	}
+	s.nextOffset.Store(s.baseOffset + entries)
+	return report, nil
+}
+
+// consistent reports whether the index entries have sequential relative offsets and increasing positions within the
+// store, and whether the first and the last entries point to the first and the last records of the store. It detects
+// a missing index file, an index file left at MaxIndexSize by a crash and garbage index contents. The records of a
+// compressed frame share its position.
+func (s *Segment) consistent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index.size%entWidth != 0 || s.index.size > uint64(len(s.index.mmap)) {
+		return false
+	}
+	entries := s.index.entries()
+	if entries == 0 {
+		return s.store.logicalSize() == s.store.headerSize()
+	}
+	prev := s.store.headerSize()
+	for i := uint64(0); i < entries; i++ {
+		off, pos, err := s.index.Read(i)
+		if err != nil || off != i || pos < prev || pos >= s.store.logicalSize() || i == 0 && pos != prev {
+			return false
+		}
+		prev = pos
+	}
+	off, pos, err := s.index.Read(entries - 1)
+	if err != nil {
+		return false
+	}
+	f, err := s.store.readFrame(pos)
+	if err != nil || f.next != s.store.logicalSize() || f.attrs&attrBatchContinue != 0 {
+		return false
+	}
+	records, err := frameRecords(f)
+	if err != nil {
+		return false
+	}
+	record := new(log_v1.Record)
+	if err := s.codec.Decode(records[len(records)-1], record); err != nil {
+		return false
+	}
+	return record.Offset == s.baseOffset+off
+}
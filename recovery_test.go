@@ -0,0 +1,356 @@
+package log
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"testing"
+)
+
+// crash releases the files of the log without the cleanup done by Close, as if the process died.
+func crash(t *testing.T, log *Log) {
+	t.Helper()
+	for _, seg := range log.segments {
+		require.NoError(t, seg.store.File.Close())
+		require.NoError(t, seg.index.mmap.Unmap())
+		require.NoError(t, seg.index.File.Close())
+		require.NoError(t, seg.timeIndex.mmap.Unmap())
+		require.NoError(t, seg.timeIndex.File.Close())
+	}
+	// the lock of the directory is released by the system when the process dies.
+	require.NoError(t, log.lock.Close())
+}
+
+func TestRecoverTornWrites(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	require.Empty(t, log.RecoveryReports())
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := log.Append([]byte(msg))
+		require.NoError(t, err)
+	}
+
+	// the process died after writing a complete frame to the store but before writing its index entry, and then in
+	// the middle of writing the next frame.
+	seg := log.activeSegment
+	data, err := proto.Marshal(&log_v1.Record{Value: []byte("unindexed"), Offset: 3})
+	require.NoError(t, err)
+	_, _, err = seg.store.Write(data)
+	require.NoError(t, err)
+	_, err = seg.store.File.WriteAt([]byte{0, 0, 0, 0, 0, 0, 0, 32, 1, 2}, int64(seg.store.size.Load()))
+	require.NoError(t, err)
+	crash(t, log)
+
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	require.Len(t, log.RecoveryReports(), 1)
+	report := log.RecoveryReports()[0]
+	require.Equal(t, uint64(1), report.RebuiltIndexEntries)
+	require.Equal(t, uint64(0), report.DroppedIndexEntries)
+	require.Equal(t, uint64(10), report.TruncatedBytes)
+	require.Equal(t, uint64(4), log.activeSegment.nextOffset.Load())
+
+	offset, err := log.Append([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), offset)
+	for i, msg := range []string{"a", "b", "c", "unindexed", "d"} {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
+
+func TestRecoverDanglingIndexEntries(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	seg, err := newSegment(dir, 8, defaultConfig)
+	require.NoError(t, err)
+	for _, msg := range []string{"a", "b"} {
+		_, err := seg.Append(&log_v1.Record{Value: []byte(msg)})
+		require.NoError(t, err)
+	}
+	// an index entry pointing past the end of the store
+	require.NoError(t, seg.index.Write(2, seg.store.size.Load()))
+	require.NoError(t, seg.Close())
+
+	seg, err = newSegment(dir, 8, defaultConfig)
+	require.NoError(t, err)
+	defer seg.Close()
+	report, err := seg.recover()
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{BaseOffset: 8, DroppedIndexEntries: 1}, *report)
+	require.Equal(t, uint64(10), seg.nextOffset.Load())
+
+	report, err = seg.recover()
+	require.NoError(t, err)
+	require.False(t, report.Repaired())
+}
+
+func TestRebuildIndexAfterCrash(t *testing.T) {
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	msgs := make([]string, 0)
+	for i := 0; i < 16; i++ {
+		msgs = append(msgs, randStr(42))
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, len(log.segments))
+	indexFileName := log.segments[2].IndexFileName()
+	// every index file is left at MaxIndexSize, and one of them is lost
+	crash(t, log)
+	require.NoError(t, os.Remove(indexFileName))
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	require.Len(t, log.RecoveryReports(), 7)
+	for i, seg := range log.segments {
+		require.Equal(t, uint64(i)*2, seg.baseOffset)
+		require.Equal(t, uint64(i+1)*2, seg.nextOffset.Load())
+	}
+	for i, msg := range msgs {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
+
+func TestRepairSegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := log.Append([]byte(msg))
+		require.NoError(t, err)
+	}
+	seg := log.activeSegment
+	copy(seg.index.mmap[2*entWidth:], []byte("garbage!garbage!"))
+	require.False(t, seg.consistent())
+
+	report, err := log.RepairSegment(0)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{RebuiltIndexEntries: 1}, *report)
+	require.True(t, seg.consistent())
+	for i, msg := range []string{"a", "b", "c"} {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+
+	_, err = log.RepairSegment(1)
+	require.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestRepairSealedSegment(t *testing.T) {
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, len(log.segments))
+
+	// the first frame of a sealed segment is corrupt.
+	seg := log.segments[1]
+	pos := seg.store.headerSize()
+	_, err = seg.store.File.WriteAt([]byte{'!'}, int64(pos+lenWidth+crcWidth+attrsWidth))
+	require.NoError(t, err)
+	entries := seg.index.copyEntries()
+	fi, err := os.Stat(seg.StoreFileName())
+	require.NoError(t, err)
+
+	// the records after the corrupt frame are not cut, the segment is left as it was.
+	_, err = log.RepairSegment(2)
+	var corruptErr *CorruptRecordError
+	require.ErrorAs(t, err, &corruptErr)
+	require.Equal(t, CorruptRecordError{BaseOffset: 2, Offset: 2, Pos: pos}, *corruptErr)
+	require.Equal(t, entries, seg.index.copyEntries())
+	require.Equal(t, uint64(4), seg.nextOffset.Load())
+	size, err := seg.store.Size()
+	require.NoError(t, err)
+	require.Equal(t, uint64(fi.Size()), size)
+	_, err = log.Read(3)
+	require.NoError(t, err)
+	_, err = log.RepairSegment(6)
+	require.NoError(t, err)
+
+	// nor are they when the log is reopened, and its index is rebuilt after a crash.
+	crash(t, log)
+	_, err = NewLog(dir, config)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	fi2, err := os.Stat(seg.StoreFileName())
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), fi2.Size())
+}
+
+func TestMisdirectedIndexEntry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	for _, codec := range []Codec{ProtoCodec{}, RawCodec{}} {
+		require.NoError(t, os.RemoveAll(dir))
+		require.NoError(t, os.Mkdir(dir, 0755))
+		config := defaultConfig
+		config.Codec = codec
+		log, err := NewLog(dir, config)
+		require.NoError(t, err)
+		for i := 0; i < 8; i++ {
+			_, err := log.Append([]byte(fmt.Sprintf("record-%d", i)))
+			require.NoError(t, err)
+		}
+
+		// an entry in the middle of the index points to the frame of another record.
+		seg := log.activeSegment
+		_, pos, err := seg.index.Read(5)
+		require.NoError(t, err)
+		endian.PutUint64(seg.index.mmap[3*entWidth+offWidth:], pos)
+		_, err = log.ReadRecord(3)
+		var corruptErr *CorruptRecordError
+		require.ErrorAs(t, err, &corruptErr)
+		require.Equal(t, CorruptRecordError{BaseOffset: 0, Offset: 3, Pos: pos}, *corruptErr)
+		require.ErrorIs(t, log.View(3, func([]byte) error { return nil }), ErrCorruptRecord)
+		require.False(t, seg.consistent())
+		require.NoError(t, log.Close())
+
+		// the index is rebuilt when the log is reopened.
+		log, err = NewLog(dir, config)
+		require.NoError(t, err)
+		require.Len(t, log.RecoveryReports(), 1)
+		record, err := log.ReadRecord(3)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), record.Offset)
+		require.Equal(t, "record-3", string(record.Value))
+		require.NoError(t, log.Close())
+	}
+}
+
+func TestRecoverPartialBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	_, _, err = log.AppendBatch([][]byte{[]byte("a"), []byte("b")})
+	require.NoError(t, err)
+	size := log.activeSegment.store.size.Load()
+	_, _, err = log.AppendBatch([][]byte{[]byte("c"), []byte("d"), []byte("e")})
+	require.NoError(t, err)
+
+	// only the first two frames of the second batch reached the disk
+	seg := log.activeSegment
+	_, pos, err := seg.index.Read(4)
+	require.NoError(t, err)
+	require.NoError(t, seg.store.File.Truncate(int64(pos)))
+	crash(t, log)
+
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	require.Len(t, log.RecoveryReports(), 1)
+	require.Equal(t, uint64(3), log.RecoveryReports()[0].DroppedIndexEntries)
+	require.Equal(t, pos-size, log.RecoveryReports()[0].TruncatedBytes)
+	require.Equal(t, size, log.activeSegment.store.size.Load())
+	require.Equal(t, uint64(2), log.activeSegment.nextOffset.Load())
+	_, err = log.Read(2)
+	require.ErrorIs(t, err, ErrIllegalOffsetRange)
+	for i, msg := range []string{"a", "b"} {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
@@ -0,0 +1,59 @@
+package log
+
+// Reset drops every record of the log and starts it again from an empty segment with baseOffset, so the next record is
+// appended at baseOffset. It is meant for a follower which installed the snapshot of its leader, and continues from the
+// record after it. The snapshots are kept. Readers and subscriptions must be recreated.
+//
+// Reset is crash safe: the manifest listing no segment but recording baseOffset replaces the manifest of the old
+// segments before their files are removed, so a crash leaves either the old log or the reset one, whose first segment
+// is created when it is reopened. The old segments are kept until the new one is published. If Reset fails after the
+// manifest is replaced, the log is failed: its methods return an error matching ErrLogFailed, and it must be closed.
+// It is reset when it is reopened.
+func (l *Log) Reset(baseOffset uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return err
+	}
+
+	if err := writeManifest(l.Dir, manifest{baseOffset: baseOffset}); err != nil {
+		return err
+	}
+	if err := l.reset(baseOffset); err != nil {
+		return l.fail("reset", err)
+	}
+	return nil
+}
+
+// reset replaces the segments of the log by an empty segment with baseOffset once the manifest recording it is
+// written. The caller must hold the lock.
+func (l *Log) reset(baseOffset uint64) error {
+	// The old segments are not sealed, their files are removed anyway. A segment with baseOffset is removed before the
+	// new one takes its file names. The readers keep the old segments until the new one is published, they no longer
+	// acquire them once they are removed.
+	for _, seg := range l.segments {
+		if err := seg.remove(); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+	seg, err := l.createSegment(baseOffset, 0)
+	if err != nil {
+		return err
+	}
+	if err := l.commitManifest([]*Segment{seg}); err != nil {
+		_ = seg.Remove()
+		return err
+	}
+	l.segments = []*Segment{seg}
+	l.activeSegment = seg
+	l.unsynced = 0
+	l.publish()
+	return nil
+}
@@ -0,0 +1,201 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestInitialOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reset-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.InitialOffset = 100
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	_, err = log.LowestOffset()
+	require.ErrorIs(t, err, ErrEmptyLog)
+	offset, err := log.Append([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), offset)
+	require.NoError(t, log.Close())
+
+	// the initial offset of an existing log is ignored.
+	config.InitialOffset = 200
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	offset, err = log.Append([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), offset)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), lowest)
+}
+
+func TestReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reset-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	for _, baseOffset := range []uint64{0, 1000} {
+		for i := 0; i < 40; i++ {
+			_, err := log.Append([]byte(randStr(42)))
+			require.NoError(t, err)
+		}
+		require.Greater(t, len(log.segments), 1)
+		old := log.segments
+
+		// the new segment may take the file names of an old one.
+		require.NoError(t, log.Reset(baseOffset))
+		require.Equal(t, 1, len(log.segments))
+		require.Equal(t, uint64(0), log.Len())
+		for _, seg := range old[1:] {
+			_, err := os.Stat(seg.StoreFileName())
+			require.ErrorIs(t, err, os.ErrNotExist)
+		}
+		_, err = log.Read(baseOffset + 1)
+		require.ErrorIs(t, err, ErrIllegalOffsetRange)
+		offset, err := log.Append([]byte("after reset"))
+		require.NoError(t, err)
+		require.Equal(t, baseOffset, offset)
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Empty(t, log.RecoveryReports())
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), highest)
+	data, err := log.Read(1000)
+	require.NoError(t, err)
+	require.Equal(t, "after reset", string(data))
+}
+
+func TestResumeReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reset-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	old := log.segments
+
+	// the process died once the manifest of the reset log replaced the old one.
+	require.NoError(t, writeManifest(dir, manifest{baseOffset: 16}))
+	crash(t, log)
+
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Equal(t, 1, len(log.segments))
+	require.Equal(t, uint64(16), log.activeSegment.baseOffset)
+	require.Equal(t, uint64(16), log.activeSegment.nextOffset.Load())
+	for _, seg := range old {
+		if seg.baseOffset == 16 {
+			continue
+		}
+		_, err := os.Stat(seg.StoreFileName())
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	offset, err := log.Append([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), offset)
+}
+
+func TestResetFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reset-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+
+	// the files of an old segment can not be removed once the manifest of the reset log replaced the old one.
+	require.NoError(t, os.Remove(log.segments[1].IndexFileName()))
+	require.ErrorIs(t, log.Reset(100), ErrLogFailed)
+	require.NotNil(t, log.activeSegment)
+
+	_, err = log.Append([]byte("a"))
+	require.ErrorIs(t, err, ErrLogFailed)
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrLogFailed)
+	_, err = log.LowestOffset()
+	require.ErrorIs(t, err, ErrLogFailed)
+	_, err = log.HighestOffset()
+	require.ErrorIs(t, err, ErrLogFailed)
+	_, err = log.NewReader(0)
+	require.ErrorIs(t, err, ErrLogFailed)
+	require.ErrorIs(t, log.Compact(0), ErrLogFailed)
+	require.ErrorIs(t, log.Truncate(0), ErrLogFailed)
+	require.ErrorIs(t, log.Sync(), ErrLogFailed)
+	require.ErrorIs(t, log.enforceRetention(), ErrLogFailed)
+	require.ErrorIs(t, log.Reset(100), ErrLogFailed)
+	require.NoError(t, log.Close())
+
+	// the log is reset when it is reopened.
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Equal(t, 1, len(log.segments))
+	offset, err := log.Append([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), offset)
+}
@@ -0,0 +1,80 @@
+package log
+
+import "time"
+
+const (
+	defaultRetentionCheckInterval = time.Minute
+)
+
+func (c RetentionConfig) enabled() bool {
+	return c.MaxBytes > 0 || c.MaxAge > 0 || c.MaxSegments > 0
+}
+
+// retentionLoop enforces the retention limits in the background until the log is closed.
+func (l *Log) retentionLoop() {
+	defer l.wg.Done()
+
+	interval := l.Config.Retention.CheckInterval
+	if interval <= 0 {
+		interval = defaultRetentionCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A segment which failed to be deleted is deleted by the next check.
+			_ = l.enforceRetention()
+		case <-l.closing:
+			return
+		}
+	}
+}
+
+// enforceRetention deletes the oldest segments while one of the retention limits is exceeded, and reports every
+// deleted segment to the OnDelete hook. It stops at the first segment used by a Reader.
+func (l *Log) enforceRetention() error {
+	config := l.Config.Retention
+
+	l.mu.Lock()
+	if err := l.failure(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	var total uint64
+	for _, seg := range l.segments {
+		total += seg.Size()
+	}
+	now := time.Now()
+	count := len(l.segments)
+	deleted := make([]SegmentInfo, 0)
+	for _, seg := range l.segments[:count-1] {
+		if seg.inUse() {
+			break
+		}
+		info, err := seg.info()
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		exceeded := config.MaxBytes > 0 && total > config.MaxBytes ||
+			config.MaxAge > 0 && now.Sub(info.Modified) > config.MaxAge ||
+			config.MaxSegments > 0 && count-len(deleted) > config.MaxSegments
+		if !exceeded {
+			break
+		}
+		total -= info.Size
+		deleted = append(deleted, info)
+	}
+	err := l.removeSegments(len(deleted))
+	// Only the segments before the one which failed are removed.
+	deleted = deleted[:count-len(l.segments)]
+	l.mu.Unlock()
+
+	if config.OnDelete != nil {
+		for _, info := range deleted {
+			config.OnDelete(info)
+		}
+	}
+	return err
+}
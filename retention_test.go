@@ -0,0 +1,192 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newRetentionLog(t *testing.T, dir string, retention RetentionConfig) *Log {
+	t.Helper()
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+		Retention: retention,
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, len(log.segments))
+	return log
+}
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention RetentionConfig
+		setUp     func(t *testing.T, log *Log)
+		deleted   []uint64
+	}{
+		{
+			name:      "max segments",
+			retention: RetentionConfig{MaxSegments: 5, CheckInterval: time.Hour},
+			deleted:   []uint64{0, 2, 4},
+		},
+		{
+			name:      "max bytes",
+			retention: RetentionConfig{MaxBytes: 420, CheckInterval: time.Hour},
+			deleted:   []uint64{0, 2, 4, 6, 8},
+		},
+		{
+			name:      "max age",
+			retention: RetentionConfig{MaxAge: time.Hour, CheckInterval: time.Hour},
+			setUp: func(t *testing.T, log *Log) {
+				old := time.Now().Add(-2 * time.Hour)
+				for _, seg := range log.segments[:2] {
+					require.NoError(t, os.Chtimes(seg.StoreFileName(), old, old))
+				}
+			},
+			deleted: []uint64{0, 2},
+		},
+		{
+			name:      "segment used by a reader",
+			retention: RetentionConfig{MaxSegments: 1, CheckInterval: time.Hour},
+			setUp: func(t *testing.T, log *Log) {
+				_, err := log.NewReader(4)
+				require.NoError(t, err)
+			},
+			deleted: []uint64{0, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "retention-test")
+			require.NoError(t, err)
+			defer func(path string) {
+				err := os.RemoveAll(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(dir)
+
+			deleted := make([]uint64, 0)
+			tt.retention.OnDelete = func(info SegmentInfo) {
+				require.Equal(t, info.BaseOffset+2, info.NextOffset)
+				deleted = append(deleted, info.BaseOffset)
+			}
+			log := newRetentionLog(t, dir, tt.retention)
+			defer func(log *Log) {
+				err := log.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(log)
+			if tt.setUp != nil {
+				tt.setUp(t, log)
+			}
+
+			require.NoError(t, log.enforceRetention())
+			require.Equal(t, tt.deleted, deleted)
+			require.Equal(t, 8-len(tt.deleted), len(log.segments))
+			for _, base := range tt.deleted {
+				_, err := log.Read(base)
+				require.ErrorIs(t, err, ErrIllegalOffsetRange)
+			}
+			_, err = log.Read(15)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRetentionInBackground(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	var mu sync.Mutex
+	deleted := 0
+	log, err := NewLog(dir, Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+		Retention: RetentionConfig{
+			MaxSegments:   2,
+			CheckInterval: time.Millisecond,
+			OnDelete: func(info SegmentInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted++
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return deleted == 6
+	}, time.Second, time.Millisecond)
+	_, err = log.Read(11)
+	require.ErrorIs(t, err, ErrIllegalOffsetRange)
+	_, err = log.Read(12)
+	require.NoError(t, err)
+}
+
+func TestCompactWithReader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log := newRetentionLog(t, dir, RetentionConfig{})
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	r, err := log.NewReader(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Compact(4))
+	require.Equal(t, 6, len(log.segments))
+	_, err = os.Stat(log.segments[0].StoreFileName())
+	require.NoError(t, err)
+
+	// the reader keeps reading the segment it uses, then skips to the oldest record left
+	for _, offset := range []uint64{0, 1, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15} {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, offset, record.Offset)
+	}
+	require.NoError(t, r.Close())
+	_, err = r.Next()
+	require.ErrorIs(t, err, ErrReaderClosed)
+}
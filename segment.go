@@ -2,43 +2,118 @@ package log
 
 import (
 	"errors"
-	"fmt"
-	"github.com/golang/protobuf/proto"
 	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"io"
 	"os"
-	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Segment struct {
-	mu    sync.Mutex
-	index *Index
-	store *Store
+	// mu serializes the writers of the segment.
+	mu sync.Mutex
+	// readMu guards the records before nextOffset against the changes which are not appends. Readers hold it shared,
+	// and truncation, index rebuilds and close hold it exclusively. Appends only write after nextOffset, so readers
+	// run alongside them.
+	readMu    sync.RWMutex
+	index     *Index
+	timeIndex *TimeIndex
+	store     *Store
 
 	baseOffset uint64
-	nextOffset uint64
+	// nextOffset is the high-water mark of the segment. It is advanced once the records before it are written to the
+	// store and the index, so readers read the records before it without taking mu.
+	nextOffset atomic.Uint64
 
-	config SegmentConfig
+	// maxTimestamp is the greatest timestamp of the log up to the last record of the segment, and prevTimestamp the
+	// one up to the last record of the previous segments. unindexed is the number of bytes appended since the last
+	// entry of the time index.
+	maxTimestamp  atomic.Int64
+	prevTimestamp int64
+	unindexed     uint64
+
+	// codec decodes the records of the segment, and encodes the records appended to it.
+	codec Codec
+	// compression compresses the records appended to the segment.
+	compression Compression
+	config      SegmentConfig
+
+	// refs is the number of readers using the segment, and removed is set once its files are removed. A removed
+	// segment is closed when the last reader releases it.
+	refs      atomic.Int64
+	removed   atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func newSegment(dir string, baseOffset uint64, config Config) (*Segment, error) {
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE, os.O_RDWR|os.O_CREATE|os.O_APPEND
+	if config.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%012d.store", baseOffset)),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		segmentFileName(dir, baseOffset, ".store"),
+		storeFlag,
 		0644,
 	)
 	if err != nil {
 		return nil, err
 	}
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%012d.index", baseOffset)),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		segmentFileName(dir, baseOffset, ".index"),
+		indexFlag,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	timeIndexFile, err := os.OpenFile(
+		segmentFileName(dir, baseOffset, ".timeindex"),
+		storeFlag,
 		0644,
 	)
+	if config.ReadOnly && errors.Is(err, os.ErrNotExist) {
+		// A segment written before the time index has none, and a read-only log can not create it. Its time index is
+		// kept in memory, and the records are searched from the start of the segment.
+		timeIndexFile, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var store *Store
+	if config.ReadOnly {
+		store, err = openStore(storeFile, baseOffset)
+	} else {
+		store, err = newStore(storeFile, baseOffset)
+	}
 	if err != nil {
 		return nil, err
 	}
-	store, err := newStore(storeFile)
+	store.readOnly = config.ReadOnly
+	if !config.ReadOnly && store.version == storeFormatVersion && store.logicalSize() == store.headerSize() {
+		// A segment without records takes the configured codec and key.
+		if id := config.codec().ID(); store.codec != id {
+			if err := store.setCodec(id); err != nil {
+				return nil, err
+			}
+		}
+		keyID, err := config.currentKeyID()
+		if err != nil {
+			return nil, err
+		}
+		if store.keyID != keyID {
+			if err := store.setKey(keyID, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if store.keyID != 0 {
+		if store.aead, err = config.newAEAD(store.keyID); err != nil {
+			return nil, err
+		}
+	}
+	codec, err := config.codecByID(store.codec)
 	if err != nil {
 		return nil, err
 	}
@@ -46,79 +121,312 @@ func newSegment(dir string, baseOffset uint64, config Config) (*Segment, error)
 	if err != nil {
 		return nil, err
 	}
+	timeIndex, err := newTimeIndex(timeIndexFile, config)
+	if err != nil {
+		return nil, err
+	}
 	segment := &Segment{
-		store:      store,
-		index:      index,
-		config:     config.SegmentConfig,
-		baseOffset: baseOffset,
-		nextOffset: baseOffset,
+		store:       store,
+		index:       index,
+		timeIndex:   timeIndex,
+		codec:       codec,
+		compression: config.Compression,
+		config:      config.SegmentConfig,
+		baseOffset:  baseOffset,
 	}
-	if last, err := index.Last(); err == nil {
-		segment.nextOffset = baseOffset + last + 1
+	segment.nextOffset.Store(baseOffset)
+	if config.ReadOnly {
+		segment.bound()
+	} else if last, err := index.Last(); err == nil {
+		segment.nextOffset.Store(baseOffset + last + 1)
 	}
 	return segment, nil
 }
 
+// preallocate reserves the store file of the segment up to the maximum segment size. Only the active segment is
+// preallocated, a sealed one keeps the size of its records. A store of an older format is not appended to and is left
+// alone.
+func (s *Segment) preallocate() error {
+	if s.store.version != storeFormatVersion {
+		return nil
+	}
+	return s.store.preallocate(s.store.headerSize() + s.config.MaxSegmentSize)
+}
+
 func (s *Segment) Append(record *log_v1.Record) (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	cur := s.nextOffset
-	record.Offset = cur
-	data, err := proto.Marshal(record)
-
-	if s.store.size+uint64(len(data)) > s.config.MaxSegmentSize {
-		return 0, ErrExceededMaxSegmentSize
+	cur, err := s.append(record)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.sync(); err != nil {
+		return 0, err
 	}
+	return cur, nil
+}
+
+// append writes the record to the store and the index without syncing them. The caller must hold the lock.
+func (s *Segment) append(record *log_v1.Record) (uint64, error) {
+	return s.appendBatch([]*log_v1.Record{record})
+}
 
+// appendBatch writes the records with contiguous offsets to the store with a single write, and to the index, without
+// syncing them. The records are compressed into a single frame if the segment has a compression and it makes them
+// smaller. It returns the offset of the first record, or ErrExceededMaxSegmentSize without writing anything if the
+// records do not fit in the store or the index. The caller must hold the lock.
+func (s *Segment) appendBatch(records []*log_v1.Record) (uint64, error) {
+	first := s.nextOffset.Load()
+	batch, attrs, size, err := s.encode(first, records)
 	if err != nil {
 		return 0, err
 	}
-	// todo write payload and index must be atomic.
-	// if s.store.write succeed and s.index.write fail, s.store.write must be rollback.
-	n, pos, err := s.store.Write(data)
+
+	if s.Size()+size > s.config.MaxSegmentSize {
+		return 0, ErrExceededMaxSegmentSize
+	}
+	if s.index.size+uint64(len(records))*entWidth > uint64(len(s.index.mmap)) {
+		return 0, ErrExceededMaxSegmentSize
+	}
+
+	// The payloads are written before their index entries. If the process dies in between, recover rebuilds the
+	// entries when the log is reopened.
+	n, positions, err := s.store.writeBatch(batch, attrs)
 	if err != nil {
 		return 0, err
 	}
-	if int(n) != len(data)+lenWidth {
+	if n != size+uint64(len(batch))*s.store.frameHeaderSize() {
 		return 0, errors.New("write data error")
 	}
-	if err := s.index.Write(cur-s.baseOffset, pos); err != nil {
+	for i := range records {
+		// the records of a compressed frame share its position.
+		pos := positions[0]
+		if len(positions) > 1 {
+			pos = positions[i]
+		}
+		if err := s.index.write(first+uint64(i)-s.baseOffset, pos); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.indexTime(records, n); err != nil {
 		return 0, err
 	}
-	s.nextOffset++
-	return cur, nil
+	s.nextOffset.Store(first + uint64(len(records)))
+	return first, nil
 }
 
-func (s *Segment) Read(offset uint64) (*log_v1.Record, error) {
+// appendFrames writes the longest prefix of records which fits in the segment to the store with a single write, and to
+// the index, without syncing them. Unlike appendBatch, every record gets a frame of its own, which is not chained to
+// the others, so a crash may keep only a part of them. It returns the offset of the first record and the number of
+// records written. If the first record can not be written, its error is returned without writing anything:
+// ErrExceededMaxSegmentSize if it does not fit in the store or the index. The caller must hold the lock.
+func (s *Segment) appendFrames(records []*log_v1.Record) (uint64, int, error) {
+	first := s.nextOffset.Load()
+	headerSize := s.store.frameHeaderSize()
+	batch := make([][]byte, 0, len(records))
+	attrs := make([]byte, 0, len(records))
+	size := uint64(0)
+	for i := range records {
+		frame, a, n, err := s.encode(first+uint64(i), records[i:i+1])
+		if err == nil && (s.Size()+size+n > s.config.MaxSegmentSize ||
+			s.index.size+uint64(i+1)*entWidth > uint64(len(s.index.mmap))) {
+			err = ErrExceededMaxSegmentSize
+		}
+		if err != nil {
+			if i == 0 {
+				return 0, 0, err
+			}
+			break
+		}
+		batch = append(batch, frame[0])
+		attrs = append(attrs, a)
+		size += headerSize + n
+	}
+	records = records[:len(batch)]
+
+	n, positions, err := s.store.writeFrames(batch, attrs, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n != size {
+		return 0, 0, errors.New("write data error")
+	}
+	for i, pos := range positions {
+		if err := s.index.write(first+uint64(i)-s.baseOffset, pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := s.indexTime(records, n); err != nil {
+		return 0, 0, err
+	}
+	s.nextOffset.Store(first + uint64(len(records)))
+	return first, len(records), nil
+}
+
+// encode encodes the records with contiguous offsets from first into the payloads of their frames. The records are
+// compressed into a single frame if the segment has a compression and it makes them smaller. It returns the payloads,
+// the attributes of their frames and their size once encrypted, without the frame headers.
+func (s *Segment) encode(first uint64, records []*log_v1.Record) ([][]byte, byte, uint64, error) {
+	batch := make([][]byte, 0, len(records))
+	size := uint64(0)
+	for i, record := range records {
+		record.Offset = first + uint64(i)
+		data, err := s.codec.Encode(nil, record)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		batch = append(batch, data)
+		size += uint64(len(data))
+	}
+	attrs := byte(0)
+	if s.compression != CompressionNone {
+		data, err := s.compression.encodeBatch(first, batch)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		headerSize := s.store.frameHeaderSize()
+		if headerSize+uint64(len(data)) < uint64(len(batch))*headerSize+size {
+			batch, size = [][]byte{data}, uint64(len(data))
+			attrs = byte(s.compression) << attrCompressionShift
+		}
+	}
+	size += uint64(len(batch)) * s.store.encryptionOverhead()
+	return batch, attrs, size, nil
+}
+
+// Sync commits the appended records to stable storage.
+func (s *Segment) Sync() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.sync()
+}
 
-	_, pos, err := s.index.Read(offset - s.baseOffset)
-	if err != nil {
-		return nil, err
+// seal syncs the segment and truncates its store file to the logical end, once it is no longer the active segment.
+func (s *Segment) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.sealTimeIndex(); err != nil {
+		return err
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	// The truncation unmaps a store which is mapped already, so it waits for the readers of the mapping. The mapping
+	// is only changed under mu.
+	if s.store.mapping.Load() != nil {
+		s.readMu.Lock()
+		defer s.readMu.Unlock()
 	}
+	return s.store.seal()
+}
 
-	data, err := s.store.Read(pos)
+// sync commits the appended records to stable storage. The store is synced before the index, so the index never
+// points to a frame which is not durable. The caller must hold the lock.
+func (s *Segment) sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
+// Read reads the record of offset. It runs alongside the appends, which do not change the records before the
+// high-water mark of the segment.
+func (s *Segment) Read(offset uint64) (*log_v1.Record, error) {
+	s.readMu.RLock()
+	defer s.readMu.RUnlock()
+	return s.record(offset)
+}
+
+// payload returns the encoded record of offset. It is a slice into the mapping of the store file if the segment is
+// sealed and the record is not compressed, so the caller must hold the read lock as long as it uses it.
+func (s *Segment) payload(offset uint64) ([]byte, error) {
+	if offset < s.baseOffset || offset >= s.nextOffset.Load() {
+		return nil, io.EOF
+	}
+	_, pos, err := s.index.entry(offset - s.baseOffset)
 	if err != nil {
 		return nil, err
 	}
-	record := new(log_v1.Record)
-	if err := proto.Unmarshal(data, record); err != nil {
-		return nil, err
+
+	attrs, data, err := s.store.view(pos)
+	if c := compressionOf(attrs); err == nil && c != CompressionNone {
+		data, err = batchRecord(c, data, offset)
+	}
+	if err == nil {
+		err = s.checkOffset(data, offset)
 	}
-	return record, nil
+	if errors.Is(err, ErrCorruptRecord) {
+		return nil, &CorruptRecordError{
+			BaseOffset: s.baseOffset,
+			Offset:     offset,
+			Pos:        pos,
+		}
+	}
+	return data, err
 }
 
-func (s *Segment) Close() error {
-	if err := s.store.Close(); err != nil {
-		return err
+// checkOffset returns ErrCorruptRecord if the encoded record data does not carry offset, when an index entry points to
+// the frame of another record.
+func (s *Segment) checkOffset(data []byte, offset uint64) error {
+	var recordOffset uint64
+	if c, ok := s.codec.(offsetCodec); ok {
+		var err error
+		if recordOffset, err = c.Offset(data); err != nil {
+			return err
+		}
+	} else {
+		record := new(log_v1.Record)
+		if err := s.codec.Decode(data, record); err != nil {
+			return err
+		}
+		recordOffset = record.Offset
 	}
-	if err := s.index.Close(); err != nil {
-		return err
+	if recordOffset != offset {
+		return ErrCorruptRecord
 	}
 	return nil
 }
 
+// batchRecord returns the encoded record of offset from the payload of a frame compressed with c.
+func batchRecord(c Compression, data []byte, offset uint64) ([]byte, error) {
+	first, records, err := c.decodeBatch(data)
+	if err != nil {
+		return nil, err
+	}
+	if offset < first || offset-first >= uint64(len(records)) {
+		return nil, ErrCorruptRecord
+	}
+	return records[offset-first], nil
+}
+
+// frameRecords returns the encoded records carried by the frame.
+func frameRecords(f frame) ([][]byte, error) {
+	c := f.compression()
+	if c == CompressionNone {
+		return [][]byte{f.data}, nil
+	}
+	_, records, err := c.decodeBatch(f.data)
+	return records, err
+}
+
+// Close closes the files of the segment once the reads in progress are done. Every file is closed even if another one
+// fails to, and the first error is returned. Closing it again does nothing.
+func (s *Segment) Close() error {
+	s.closeOnce.Do(func() {
+		s.readMu.Lock()
+		defer s.readMu.Unlock()
+		for _, closer := range []io.Closer{s.store, s.index, s.timeIndex} {
+			if err := closer.Close(); err != nil && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
+	})
+	return s.closeErr
+}
+
 func (s *Segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -129,6 +437,9 @@ func (s *Segment) Remove() error {
 	if err := os.RemoveAll(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -140,6 +451,106 @@ func (s *Segment) StoreFileName() string {
 	return s.store.Name()
 }
 
+// TimeIndexFileName returns the name of the time index file, or an empty string if a read-only log opened the segment
+// without one.
+func (s *Segment) TimeIndexFileName() string {
+	if s.timeIndex.File == nil {
+		return ""
+	}
+	return s.timeIndex.Name()
+}
+
+// SegmentInfo describes a segment of the log.
+type SegmentInfo struct {
+	BaseOffset uint64
+	NextOffset uint64
+	// Size is the size of the records in the store file.
+	Size uint64
+
+	IndexFileName     string
+	StoreFileName     string
+	TimeIndexFileName string
+
+	// FormatVersion is the format version of the store file, zero for the store files written before it had a header.
+	FormatVersion uint32
+	// Created is the time the segment was created. It is zero for the segments written before the store header
+	// recorded it.
+	Created time.Time
+	// Modified is the time of the last append to the segment.
+	Modified time.Time
+}
+
+// info returns the descriptor of the segment.
+func (s *Segment) info() (SegmentInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := s.store.File.Stat()
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	return SegmentInfo{
+		BaseOffset:        s.baseOffset,
+		NextOffset:        s.nextOffset.Load(),
+		Size:              s.Size(),
+		IndexFileName:     s.index.Name(),
+		StoreFileName:     s.store.Name(),
+		TimeIndexFileName: s.TimeIndexFileName(),
+		FormatVersion:     s.store.version,
+		Created:           s.store.created,
+		Modified:          fi.ModTime(),
+	}, nil
+}
+
+// Size returns the size of the records in the store file. The store header is not counted.
 func (s *Segment) Size() uint64 {
-	return s.store.size
+	return s.store.logicalSize() - s.store.headerSize()
+}
+
+// acquire marks the segment as used by a reader, so it is not closed while the reader uses it. The caller must hold
+// the log lock, so the segment is not removed in the meantime.
+func (s *Segment) acquire() {
+	s.refs.Add(1)
+}
+
+// tryAcquire acquires the segment unless it was removed, for the readers which found it without holding the log
+// lock. A removed segment may be closed already.
+func (s *Segment) tryAcquire() bool {
+	s.refs.Add(1)
+	if s.removed.Load() {
+		_ = s.release()
+		return false
+	}
+	return true
+}
+
+// release undoes acquire, and closes the segment if it was removed while in use.
+func (s *Segment) release() error {
+	if s.refs.Add(-1) == 0 && s.removed.Load() {
+		return s.Close()
+	}
+	return nil
+}
+
+// inUse reports whether a reader uses the segment.
+func (s *Segment) inUse() bool {
+	return s.refs.Load() > 0
+}
+
+// remove removes the files of the segment. The segment is closed at once if no reader uses it, or else when the last
+// reader releases it.
+func (s *Segment) remove() error {
+	s.removed.Store(true)
+	if err := os.Remove(s.index.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.store.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
+	if s.inUse() {
+		return nil
+	}
+	return s.Close()
 }
@@ -94,3 +94,88 @@ func TestSegmentClose(t *testing.T) {
 	_, err = os.Stat(storeFileName)
 	require.False(t, os.IsExist(err), "store file must be deleted")
 }
+
+func TestSegmentCorruptRecord(t *testing.T) {
+	dir := setUp(t, "")
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	seg, err := newSegment(dir, 16, defaultConfig)
+	require.NoError(t, err)
+	defer seg.Close()
+
+	for _, value := range []string{"A", "B"} {
+		_, err := seg.Append(&log_v1.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	_, pos, err := seg.index.Read(1)
+	require.NoError(t, err)
+	f, err := os.OpenFile(seg.StoreFileName(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos+lenWidth+crcWidth+attrsWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = seg.Read(17)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	var corrupt *CorruptRecordError
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, CorruptRecordError{BaseOffset: 16, Offset: 17, Pos: pos}, *corrupt)
+
+	r, err := seg.Read(16)
+	require.NoError(t, err)
+	require.Equal(t, "A", string(r.Value))
+}
+
+func TestSegmentAppendFrames(t *testing.T) {
+	dir := setUp(t, "")
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.SegmentConfig.MaxSegmentSize = 64
+	seg, err := newSegment(dir, 0, config)
+	require.NoError(t, err)
+	defer func(seg *Segment) {
+		err := seg.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(seg)
+
+	var records []*log_v1.Record
+	for i := 0; i < 4; i++ {
+		records = append(records, &log_v1.Record{Value: []byte(randStr(20))})
+	}
+	// Only a part of the records fits in the segment, the others are left for the next one.
+	first, n, err := seg.appendFrames(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Greater(t, n, 1)
+	require.Less(t, n, len(records))
+	require.Equal(t, uint64(n), seg.nextOffset.Load())
+
+	// Every record has a frame of its own, which is not chained to the next one.
+	for i, record := range records[:n] {
+		_, pos, err := seg.index.Read(uint64(i))
+		require.NoError(t, err)
+		f, err := seg.store.readFrame(pos)
+		require.NoError(t, err)
+		require.Zero(t, f.attrs&attrBatchContinue)
+		r, err := seg.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, r.Value)
+	}
+
+	_, _, err = seg.appendFrames(records[n:])
+	require.ErrorIs(t, err, ErrExceededMaxSegmentSize)
+	require.Equal(t, uint64(n), seg.nextOffset.Load())
+}
@@ -0,0 +1,186 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshotDirName is the name of the subdirectory of the log holding the snapshots.
+	snapshotDirName = "snapshots"
+	snapshotExt     = ".snapshot"
+	// snapshotTempExt is the extension of a snapshot being written.
+	snapshotTempExt = ".tmp"
+)
+
+// Snapshot describes a snapshot of the state built from the records of the log, saved by Log.SaveSnapshot.
+type Snapshot struct {
+	// Offset is the offset of the last record the state of the snapshot includes. The records are replayed from the
+	// next one.
+	Offset uint64
+	// FileName is the name of the snapshot file, and Size its size.
+	FileName string
+	Size     int64
+	// Created is the time the snapshot was saved.
+	Created time.Time
+}
+
+// Open opens the snapshot file for reading. The file may be deleted once a newer snapshot is saved, but an open file
+// stays readable until it is closed.
+func (s *Snapshot) Open() (*os.File, error) {
+	return os.Open(s.FileName)
+}
+
+// SaveSnapshot saves the data read from r as the snapshot of the state which includes the records up to offset. The
+// snapshot is written to a temporary file in the snapshots subdirectory of the log, synced and renamed, so a crash
+// never leaves a partial snapshot. The segments whose records are all included in the snapshot are then removed by
+// Compact, and the oldest snapshots are deleted so Config.Snapshot.MaxSnapshots are kept.
+func (l *Log) SaveSnapshot(offset uint64, r io.Reader) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.failure(); err != nil {
+		return err
+	}
+	if segments := l.segmentsView(); offset >= segments[len(segments)-1].nextOffset.Load() {
+		return ErrIllegalOffsetRange
+	}
+
+	// Snapshots are saved one at a time, so the pruning does not remove the temporary file of another one.
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+
+	dir := path.Join(l.Dir, snapshotDirName)
+	if err := os.Mkdir(dir, 0755); err == nil {
+		// The new directory is committed to the log directory, so the snapshot is not lost with it.
+		if err := syncDir(l.Dir); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	name := path.Join(dir, fmt.Sprintf("%012d%s", offset, snapshotExt))
+	f, err := os.OpenFile(name+snapshotTempExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	if err := l.pruneSnapshots(); err != nil {
+		return err
+	}
+	return l.Compact(offset + 1)
+}
+
+// LatestSnapshot returns the snapshot with the highest offset, or ErrNoSnapshot if no snapshot was saved.
+func (l *Log) LatestSnapshot() (*Snapshot, error) {
+	snapshots, err := l.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, ErrNoSnapshot
+	}
+	return snapshots[len(snapshots)-1], nil
+}
+
+// listSnapshots returns the snapshots of the log by increasing offset.
+func (l *Log) listSnapshots() ([]*Snapshot, error) {
+	dir := path.Join(l.Dir, snapshotDirName)
+	dirEntries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if path.Ext(name) != snapshotExt {
+			continue
+		}
+		offset, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted by the pruning in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &Snapshot{
+			Offset:   offset,
+			FileName: path.Join(dir, name),
+			Size:     fi.Size(),
+			Created:  fi.ModTime(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Offset < snapshots[j].Offset
+	})
+	return snapshots, nil
+}
+
+// pruneSnapshots deletes the oldest snapshots beyond Config.Snapshot.MaxSnapshots, and the temporary files left by a
+// crash. The caller must hold snapshotMu.
+func (l *Log) pruneSnapshots() error {
+	snapshots, err := l.listSnapshots()
+	if err != nil {
+		return err
+	}
+	dir := path.Join(l.Dir, snapshotDirName)
+	names := make([]string, 0)
+	if n := len(snapshots) - l.Config.Snapshot.maxSnapshots(); n > 0 {
+		for _, snapshot := range snapshots[:n] {
+			names = append(names, snapshot.FileName)
+		}
+	}
+	temps, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range temps {
+		if path.Ext(entry.Name()) == snapshotTempExt {
+			names = append(names, path.Join(dir, entry.Name()))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.Snapshot.MaxSnapshots = 2
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	_, err = log.LatestSnapshot()
+	require.ErrorIs(t, err, ErrNoSnapshot)
+	require.ErrorIs(t, log.SaveSnapshot(0, bytes.NewReader(nil)), ErrIllegalOffsetRange)
+
+	for i := 0; i < 60; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 3)
+	require.ErrorIs(t, log.SaveSnapshot(60, bytes.NewReader(nil)), ErrIllegalOffsetRange)
+
+	for _, offset := range []uint64{14, 29, 44} {
+		require.NoError(t, log.SaveSnapshot(offset, bytes.NewReader([]byte(fmt.Sprintf("state-%d", offset)))))
+		snapshot, err := log.LatestSnapshot()
+		require.NoError(t, err)
+		require.Equal(t, offset, snapshot.Offset)
+		f, err := snapshot.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Equal(t, fmt.Sprintf("state-%d", offset), string(data))
+		require.Equal(t, int64(len(data)), snapshot.Size)
+
+		// the segments whose records are all in the snapshot are compacted, the replay starts right after it.
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.LessOrEqual(t, lowest, offset+1)
+		require.Greater(t, log.segments[0].nextOffset.Load(), offset+1)
+		_, err = log.Read(offset + 1)
+		require.NoError(t, err)
+	}
+
+	// the oldest snapshot is pruned.
+	snapshots, err := log.listSnapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	require.Equal(t, uint64(29), snapshots[0].Offset)
+	require.Equal(t, uint64(44), snapshots[1].Offset)
+
+	// a failed snapshot leaves no file behind, and the latest snapshot is kept.
+	require.Error(t, log.SaveSnapshot(59, io.MultiReader(bytes.NewReader([]byte("partial")), failingReader{})))
+	entries, err := os.ReadDir(path.Join(dir, snapshotDirName))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	snapshot, err := log.LatestSnapshot()
+	require.NoError(t, err)
+	require.Equal(t, uint64(44), snapshot.Offset)
+
+	// the temporary file of a snapshot the process died writing is removed by the next one.
+	temp := path.Join(dir, snapshotDirName, fmt.Sprintf("%012d%s%s", 50, snapshotExt, snapshotTempExt))
+	require.NoError(t, os.WriteFile(temp, []byte("partial"), 0644))
+	require.NoError(t, log.SaveSnapshot(59, bytes.NewReader([]byte("state-59"))))
+	_, err = os.Stat(temp)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
@@ -1,34 +1,260 @@
 package log
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"github.com/edsrzf/mmap-go"
+	"hash/crc32"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	endian = binary.BigEndian
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// storeMagic marks the beginning of a store file which carries a header. Store files written before the header
+	// was introduced start with the 8 bytes big endian length of the first record, so the first bytes are zero for
+	// any record smaller than 4GB and can never be mistaken for the magic.
+	storeMagic = []byte("YAWL")
+)
+
+const (
+	lenWidth   = 8
+	crcWidth   = 4
+	attrsWidth = 1
+
+	magicWidth      = 4
+	versionWidth    = 4
+	createdWidth    = 8
+	codecWidth      = 1
+	keyIDWidth      = 4
+	baseOffsetWidth = 8
+	featuresWidth   = 4
+
+	createdPos    = magicWidth + versionWidth
+	codecPos      = createdPos + createdWidth
+	keyIDPos      = codecPos + codecWidth
+	baseOffsetPos = keyIDPos + keyIDWidth
+	featuresPos   = baseOffsetPos + baseOffsetWidth
+
+	// storeHeaderSize is the size of the header at the beginning of a store file. Only the magic, the format version,
+	// the creation time, the codec, the key ID, the base offset and the features are used, the remaining bytes are
+	// reserved for segment metadata and must be zero.
+	storeHeaderSize = 64
+)
+
+const (
+	// storeFormatLegacy is the format of the store files without header. Every frame is the length of the payload
+	// followed by the payload.
+	storeFormatLegacy uint32 = iota
+	// storeFormatV1 adds a CRC32C (Castagnoli) checksum of the length and the payload to every frame. The checksum
+	// is placed between the length and the payload.
+	storeFormatV1
+	// storeFormatV2 adds an attributes byte between the checksum and the payload. The checksum covers the length, the
+	// attributes and the payload.
+	storeFormatV2
+	// storeFormatV3 records the base offset of the segment and its features in the header. The frames are the ones of
+	// storeFormatV2.
+	storeFormatV3
+
+	storeFormatVersion = storeFormatV3
 )
 
 const (
-	lenWidth = 8
+	// featureChecksum is set if the frames carry a checksum. It is always set from storeFormatV3 on.
+	featureChecksum uint32 = 1 << iota
+	// featureCompression is set once a compressed frame is written to the store.
+	featureCompression
+	// featureEncryption is set if the payloads of the frames are encrypted with the key recorded in the header.
+	featureEncryption
+
+	// storeFeatures are the features known by this version of the package. A store file with another feature can not
+	// be read.
+	storeFeatures = featureChecksum | featureCompression | featureEncryption
+)
+
+const (
+	// attrBatchContinue is set on every frame of a batch but the last one. Recovery drops the frames of a batch
+	// whose last frame is missing.
+	attrBatchContinue byte = 1 << iota
+)
+
+const (
+	// attrCompression holds the Compression of a frame carrying a compressed batch of records. A frame without it
+	// carries a single record.
+	attrCompression      byte = 0x0e
+	attrCompressionShift      = 1
 )
 
+// frame is a frame read from the store file.
+type frame struct {
+	// pos is the position of the frame and next is the position of the frame after it.
+	pos  uint64
+	next uint64
+
+	attrs byte
+	data  []byte
+}
+
+// compression returns the compression of the records of the frame.
+func (f frame) compression() Compression {
+	return compressionOf(f.attrs)
+}
+
+// compressionOf returns the compression recorded in the attributes of a frame.
+func compressionOf(attrs byte) Compression {
+	return Compression(attrs & attrCompression >> attrCompressionShift)
+}
+
 type Store struct {
 	*os.File
-	mu   sync.Mutex
-	size uint64
+	// mu serializes the writes. The frames before size are never changed by appends, so they are read without it.
+	mu sync.Mutex
+	// size is the logical end of the store. The file may be larger when it is preallocated.
+	size    atomic.Uint64
+	version uint32
+	// created is the time the store file was created, it is zero if the header does not record it.
+	created time.Time
+	// codec is the ID of the codec of the records, CodecProto if the header does not record it.
+	codec uint8
+	// keyID is the ID of the key the payloads of the frames are encrypted with, and aead encrypts them. The payloads
+	// are not encrypted if keyID is zero.
+	keyID uint32
+	aead  cipher.AEAD
+	// baseOffset is the base offset of the segment of the store, and features are its features. They are only recorded
+	// in the header from storeFormatV3 on.
+	baseOffset uint64
+	features   uint32
+	// capacity is the size the store file is preallocated to.
+	capacity uint64
+	// readOnly is set if the store file belongs to a read-only log, it is then never written to.
+	readOnly bool
+	// mapping is the read-only memory mapping of a sealed store file, nil while the store is appended to. It is only
+	// unmapped by close and truncate, which the segment runs once its readers are done.
+	mapping atomic.Pointer[mmap.MMap]
+}
+
+func newStore(f *os.File, baseOffset uint64) (*Store, error) {
+	s, err := openStore(f, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	if s.version == storeFormatVersion && s.size.Load() < storeHeaderSize {
+		// A new store file, or a header torn by a crash before any record was written.
+		if err := s.writeHeader(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-func newStore(f *os.File) (*Store, error) {
+// openStore reads the header of the store file of the segment with baseOffset without writing to it. A store file too
+// small to hold the header has the current format and no record. A FormatError is returned if the header has an unknown
+// format version or feature, or the base offset of another segment.
+func openStore(f *os.File, baseOffset uint64) (*Store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
-	return &Store{
-		File: f,
-		size: uint64(fi.Size()),
-	}, nil
+	s := &Store{
+		File:       f,
+		baseOffset: baseOffset,
+	}
+	s.size.Store(uint64(fi.Size()))
+	if s.size.Load() >= magicWidth {
+		magic := make([]byte, magicWidth)
+		if _, err := f.ReadAt(magic, 0); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(magic, storeMagic) {
+			s.version = storeFormatLegacy
+			return s, nil
+		}
+	}
+	if s.size.Load() < storeHeaderSize {
+		s.version = storeFormatVersion
+		s.codec = CodecProto
+		return s, nil
+	}
+	header := make([]byte, storeHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	s.version = endian.Uint32(header[magicWidth : magicWidth+versionWidth])
+	if created := endian.Uint64(header[createdPos : createdPos+createdWidth]); created > 0 {
+		s.created = time.Unix(0, int64(created))
+	}
+	s.codec = header[codecPos]
+	s.keyID = endian.Uint32(header[keyIDPos : keyIDPos+keyIDWidth])
+	if s.version >= storeFormatV3 {
+		s.features = endian.Uint32(header[featuresPos : featuresPos+featuresWidth])
+		if base := endian.Uint64(header[baseOffsetPos : baseOffsetPos+baseOffsetWidth]); base != baseOffset {
+			return nil, &FormatError{File: f.Name(), Version: s.version, Features: s.features, BaseOffset: base}
+		}
+	}
+	if s.version > storeFormatVersion || s.features&^storeFeatures != 0 {
+		return nil, &FormatError{File: f.Name(), Version: s.version, Features: s.features, BaseOffset: baseOffset}
+	}
+	return s, nil
+}
+
+// writeHeader resets the store file to an empty file of the current format.
+func (s *Store) writeHeader() error {
+	if err := s.File.Truncate(0); err != nil {
+		return err
+	}
+	header := make([]byte, storeHeaderSize)
+	copy(header, storeMagic)
+	endian.PutUint32(header[magicWidth:magicWidth+versionWidth], storeFormatVersion)
+	created := time.Now()
+	endian.PutUint64(header[createdPos:createdPos+createdWidth], uint64(created.UnixNano()))
+	endian.PutUint64(header[baseOffsetPos:baseOffsetPos+baseOffsetWidth], s.baseOffset)
+	endian.PutUint32(header[featuresPos:featuresPos+featuresWidth], featureChecksum)
+	if _, err := s.File.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.size.Store(storeHeaderSize)
+	s.version = storeFormatVersion
+	s.created = created
+	s.codec = CodecProto
+	s.keyID = 0
+	s.aead = nil
+	s.features = featureChecksum
+	return nil
+}
+
+// setFeatures records the features of the store in the header. The caller must hold the lock.
+func (s *Store) setFeatures(features uint32) error {
+	buf := make([]byte, featuresWidth)
+	endian.PutUint32(buf, features)
+	if _, err := s.File.WriteAt(buf, featuresPos); err != nil {
+		return err
+	}
+	s.features = features
+	return nil
+}
+
+// setCodec records the codec of the records in the header. The store must not have records yet.
+func (s *Store) setCodec(id uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.File.WriteAt([]byte{id}, codecPos); err != nil {
+		return err
+	}
+	if err := fdatasync(s.File); err != nil {
+		return err
+	}
+	s.codec = id
+	return nil
 }
 
 func (s *Store) Size() (uint64, error) {
@@ -39,51 +265,409 @@ func (s *Store) Size() (uint64, error) {
 	return uint64(fi.Size()), nil
 }
 
+// headerSize returns the size of the header at the beginning of the store file.
+func (s *Store) headerSize() uint64 {
+	if s.version == storeFormatLegacy {
+		return 0
+	}
+	return storeHeaderSize
+}
+
+// frameHeaderSize returns the number of bytes preceding the payload of a frame.
+func (s *Store) frameHeaderSize() uint64 {
+	switch s.version {
+	case storeFormatLegacy:
+		return lenWidth
+	case storeFormatV1:
+		return lenWidth + crcWidth
+	default:
+		return lenWidth + crcWidth + attrsWidth
+	}
+}
+
+// Read reads the decrypted payload of the frame at pos. ErrCorruptRecord is returned if the frame does not fit in the
+// store, the checksum does not match or the payload does not decrypt. It does not wait for the writes in progress.
 func (s *Store) Read(pos uint64) ([]byte, error) {
+	f, err := s.readFrame(pos)
+	return f.data, err
+}
+
+// view returns the attributes and the payload of the frame at pos like Read. The payload of a sealed store which is
+// not encrypted is a slice into the mapping of the store file instead of a copy: it stays valid until the store is
+// truncated or closed, and must not be modified.
+func (s *Store) view(pos uint64) (byte, []byte, error) {
+	m := s.mapping.Load()
+	if m == nil {
+		f, err := s.readFrame(pos)
+		return f.attrs, f.data, err
+	}
+	data := *m
+	size := s.size.Load()
+	if uint64(len(data)) < size {
+		size = uint64(len(data))
+	}
+	headerSize := s.frameHeaderSize()
+	if pos+headerSize > size {
+		return 0, nil, ErrCorruptRecord
+	}
+	header := data[pos : pos+headerSize]
+	length := endian.Uint64(header[:lenWidth])
+	if length > size-pos-headerSize {
+		return 0, nil, ErrCorruptRecord
+	}
+	payload := data[pos+headerSize : pos+headerSize+length]
+	attrs, err := s.checkFrame(header, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if payload, err = s.decrypt(pos, payload); err != nil {
+		return 0, nil, err
+	}
+	return attrs, payload, nil
+}
+
+// readFrame reads the frame at pos, which must end before the logical end of the store, and decrypts its payload.
+func (s *Store) readFrame(pos uint64) (frame, error) {
+	f, err := s.readRawFrame(pos)
+	if err != nil {
+		return frame{}, err
+	}
+	if f.data, err = s.decrypt(pos, f.data); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+// readRawFrame reads the frame at pos like readFrame, without decrypting its payload.
+func (s *Store) readRawFrame(pos uint64) (frame, error) {
+	size := s.size.Load()
+	headerSize := s.frameHeaderSize()
+	if pos+headerSize > size {
+		return frame{}, ErrCorruptRecord
+	}
+	header := make([]byte, headerSize)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return frame{}, err
+	}
+	length := endian.Uint64(header[:lenWidth])
+	if length > size-pos-headerSize {
+		return frame{}, ErrCorruptRecord
+	}
+	f := frame{
+		pos:  pos,
+		next: pos + headerSize + length,
+		data: make([]byte, length),
+	}
+	if _, err := s.File.ReadAt(f.data, int64(pos+headerSize)); err != nil {
+		return frame{}, err
+	}
+	attrs, err := s.checkFrame(header, f.data)
+	if err != nil {
+		return frame{}, err
+	}
+	f.attrs = attrs
+	return f, nil
+}
+
+// checkFrame verifies the checksum of the frame with the given header and payload, and returns its attributes.
+func (s *Store) checkFrame(header []byte, data []byte) (byte, error) {
+	switch s.version {
+	case storeFormatLegacy:
+		return 0, nil
+	case storeFormatV1:
+		if endian.Uint32(header[lenWidth:]) != checksum(header[:lenWidth], data) {
+			return 0, ErrCorruptRecord
+		}
+		return 0, nil
+	default:
+		if endian.Uint32(header[lenWidth:]) != checksum(header[:lenWidth], header[lenWidth+crcWidth:], data) {
+			return 0, ErrCorruptRecord
+		}
+		return header[lenWidth+crcWidth], nil
+	}
+}
+
+// logicalSize returns the logical end of the store.
+func (s *Store) logicalSize() uint64 {
+	return s.size.Load()
+}
+
+// errStopScan is returned by the callback of scan to stop at the current frame.
+var errStopScan = errors.New("stop scan")
+
+// scan calls fn with every frame from pos to the end of the store. It stops at the first partial or corrupt frame, or
+// at the frame for which fn returns errStopScan, and returns the position right after the last accepted frame.
+func (s *Store) scan(pos uint64, fn func(f frame) error) (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	//if err := s.File.Sync(); err != nil {
-	//	return nil, err
-	//}
-	length := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(length, int64(pos)); err != nil {
-		return nil, err
+	for pos < s.size.Load() {
+		f, err := s.readFrame(pos)
+		if errors.Is(err, ErrCorruptRecord) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := fn(f); errors.Is(err, errStopScan) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		pos = f.next
 	}
-	data := make([]byte, endian.Uint64(length))
-	if _, err := s.File.ReadAt(data, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	return pos, nil
+}
+
+// truncate discards everything after size. The store file is unmapped first, so the caller must make sure no reader
+// uses the mapping.
+func (s *Store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.unmapFile(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size.Store(size)
+	if err := s.allocate(); err != nil {
+		return err
 	}
-	return data, nil
+	return s.File.Sync()
 }
 
 func (s *Store) Write(data []byte) (n uint64, pos uint64, err error) {
+	n, pos, err = s.write(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.Sync(); err != nil {
+		return 0, 0, err
+	}
+	return n, pos, nil
+}
+
+// write appends a frame of data to the store file without syncing it.
+func (s *Store) write(data []byte) (n uint64, pos uint64, err error) {
+	n, positions, err := s.writeBatch([][]byte{data}, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, positions[0], nil
+}
+
+// writeBatch appends a frame for every payload of batch to the store file with a single write, without syncing it.
+// The payloads are encrypted if the store has a key. The frames carry attrs, and recovery keeps all of them or none
+// of them. It returns the number of bytes written and the positions of the frames.
+func (s *Store) writeBatch(batch [][]byte, attrs byte) (n uint64, positions []uint64, err error) {
+	frameAttrs := make([]byte, len(batch))
+	for i := range frameAttrs {
+		frameAttrs[i] = attrs
+		if i < len(batch)-1 {
+			frameAttrs[i] |= attrBatchContinue
+		}
+	}
+	return s.writeFrames(batch, frameAttrs, true)
+}
+
+// writeFrames appends the frames of batch like writeBatch, the frame of batch[i] carrying attrs[i]. The payloads are
+// encrypted if encrypt is set, or else they are encrypted already.
+func (s *Store) writeFrames(batch [][]byte, attrs []byte, encrypt bool) (n uint64, positions []uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	buf := make([]byte, lenWidth+len(data))
-	endian.PutUint64(buf[0:lenWidth], uint64(len(data)))
-	copy(buf[lenWidth:], data)
+	// The frames of storeFormatV2 are the current ones, so a store of that format takes the frame replacing a
+	// compressed frame on truncation.
+	if s.version < storeFormatV2 {
+		return 0, nil, ErrLegacyFormat
+	}
+	// The feature is recorded before the first compressed frame is written, so it is never missing.
+	compressed := false
+	for _, a := range attrs {
+		compressed = compressed || a&attrCompression != 0
+	}
+	if compressed && s.version >= storeFormatV3 && s.features&featureCompression == 0 {
+		if err := s.setFeatures(s.features | featureCompression); err != nil {
+			return 0, nil, err
+		}
+		if err := fdatasync(s.File); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	headerSize := s.frameHeaderSize()
+	size := uint64(0)
+	for _, data := range batch {
+		size += headerSize + uint64(len(data))
+		if encrypt {
+			size += s.encryptionOverhead()
+		}
+	}
+	buf := make([]byte, 0, size)
+	base := s.size.Load()
+	positions = make([]uint64, 0, len(batch))
+	header := make([]byte, headerSize)
+	for i, data := range batch {
+		pos := base + uint64(len(buf))
+		positions = append(positions, pos)
+		if encrypt {
+			if data, err = s.encrypt(pos, data); err != nil {
+				return 0, nil, err
+			}
+		}
+		endian.PutUint64(header[0:lenWidth], uint64(len(data)))
+		header[lenWidth+crcWidth] = attrs[i]
+		endian.PutUint32(header[lenWidth:lenWidth+crcWidth], checksum(header[0:lenWidth], header[lenWidth+crcWidth:], data))
+		buf = append(buf, header...)
+		buf = append(buf, data...)
+	}
 
-	pos = s.size
-	w, err := s.File.Write(buf)
+	w, err := s.File.WriteAt(buf, int64(base))
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, err
 	}
-	s.size += uint64(w)
-	// todo Use fdatasync instead of fsync. Cause MacOS does not support fdatasync immediately, so there is no
-	// need to support fdatasync at early version.
-	if err := s.File.Sync(); err != nil {
-		return 0, 0, err
+	s.size.Store(base + uint64(w))
+	return uint64(w), positions, nil
+}
+
+// endBatch makes the frame at pos the last frame of its batch, and returns the position after it. The frames of the
+// batch after it are no longer recovered with it.
+func (s *Store) endBatch(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.readRawFrame(pos)
+	if err != nil {
+		return 0, err
+	}
+	if f.attrs&attrBatchContinue == 0 {
+		return f.next, nil
+	}
+	header := make([]byte, s.frameHeaderSize())
+	endian.PutUint64(header[0:lenWidth], uint64(len(f.data)))
+	header[lenWidth+crcWidth] = f.attrs &^ attrBatchContinue
+	endian.PutUint32(header[lenWidth:lenWidth+crcWidth], checksum(header[0:lenWidth], header[lenWidth+crcWidth:], f.data))
+	if _, err := s.File.WriteAt(header, int64(pos)); err != nil {
+		return 0, err
+	}
+	return f.next, fdatasync(s.File)
+}
+
+// Sync commits the written frames to stable storage.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fdatasync(s.File)
+}
+
+// preallocate reserves the store file up to size, so appends within it do not change the file size and a sync does
+// not have to commit the file size.
+func (s *Store) preallocate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = size
+	return s.allocate()
+}
+
+// allocate reserves the store file up to the capacity. The caller must hold the lock.
+func (s *Store) allocate() error {
+	if s.capacity <= s.size.Load() {
+		return nil
+	}
+	return preallocate(s.File, int64(s.capacity))
+}
+
+// seal truncates the store file to its logical end, stops preallocating it and maps it to memory, as it is no longer
+// appended to.
+func (s *Store) seal() error {
+	s.mu.Lock()
+	s.capacity = 0
+	s.mu.Unlock()
+	if err := s.truncate(s.size.Load()); err != nil {
+		return err
+	}
+	return s.mapFile()
+}
+
+// mapFile maps the store file to memory, so the frames of a sealed store are read without copy. It does nothing for
+// an empty store file, which can not be mapped.
+func (s *Store) mapFile() error {
+	if s.mapping.Load() != nil || s.size.Load() == 0 {
+		return nil
+	}
+	m, err := mmap.Map(s.File, mmap.RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	s.mapping.Store(&m)
+	return nil
+}
+
+// unmapFile removes the mapping of the store file before the store is appended to again or closed. The caller must
+// make sure no reader uses the mapping.
+func (s *Store) unmapFile() error {
+	m := s.mapping.Swap(nil)
+	if m == nil {
+		return nil
 	}
+	return m.Unmap()
+}
 
-	return uint64(w), pos, err
+// dataEnd returns the position after the last non-zero byte from pos to the end of the store, so the zeroed space
+// of a preallocated store file is not mistaken for data.
+func (s *Store) dataEnd(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := make([]byte, 64*1024)
+	end := s.size.Load()
+	for end > pos {
+		n := uint64(len(buf))
+		if end-pos < n {
+			n = end - pos
+		}
+		chunk := buf[:n]
+		if _, err := s.File.ReadAt(chunk, int64(end-n)); err != nil {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != 0 {
+				return end - n + uint64(i) + 1, nil
+			}
+		}
+		end -= n
+	}
+	return pos, nil
 }
 
 func (s *Store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.readOnly {
+		return s.File.Close()
+	}
+	if err := s.unmapFile(); err != nil {
+		return err
+	}
+	if fi, err := s.File.Stat(); err != nil {
+		return err
+	} else if size := s.size.Load(); uint64(fi.Size()) > size {
+		if err := s.File.Truncate(int64(size)); err != nil {
+			return err
+		}
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
 	if err := s.File.Close(); err != nil {
 		return err
 	}
 	return nil
 }
+
+// checksum computes the CRC32C of the parts of a frame.
+func checksum(parts ...[]byte) uint32 {
+	var crc uint32
+	for _, part := range parts {
+		crc = crc32.Update(crc, crcTable, part)
+	}
+	return crc
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package log
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fdatasync commits the data of f to stable storage. Unlike fsync it skips the metadata which is not needed to read
+// the data back, such as the modification time.
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// preallocate allocates the blocks of f up to size and extends the file to size. It does nothing if the file system
+// does not support fallocate.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
+
+// syncDir commits the entries of the directory, such as created, renamed and removed files, to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// fdatasync falls back to fsync where fdatasync is not available.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// preallocate does nothing where fallocate is not available, the store file grows with every append.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
+
+// syncDir commits the entries of the directory to stable storage where directories can be synced. It does nothing
+// where they can not, such as on Windows.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	_ = f.Sync()
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"math/rand"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -11,7 +12,7 @@ import (
 
 var (
 	msg   = "hello, world"
-	width = uint64(len(msg)) + lenWidth
+	width = uint64(len(msg)) + lenWidth + crcWidth + attrsWidth
 	src   = rand.NewSource(time.Now().UnixNano())
 )
 
@@ -46,7 +47,7 @@ func TestStoreWriteAndRead(t *testing.T) {
 	f, err := os.CreateTemp("", "test_store_write_and_read")
 	require.NoError(t, err)
 	defer os.RemoveAll(f.Name())
-	store, err := newStore(f)
+	store, err := newStore(f, 0)
 	require.NoError(t, err)
 	testWrite(t, store)
 	testRead(t, store)
@@ -57,27 +58,162 @@ func testWrite(t *testing.T, s *Store) {
 	for i := 0; i < 4; i++ {
 		n, pos, err := s.Write([]byte(msg))
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*uint64(i+1))
+		require.Equal(t, pos+n, storeHeaderSize+width*uint64(i+1))
 	}
 }
 
 func testRead(t *testing.T, s *Store) {
 	t.Helper()
 	for i := 0; i < 4; i++ {
-		pos := width * uint64(i)
+		pos := storeHeaderSize + width*uint64(i)
 		data, err := s.Read(pos)
 		require.NoError(t, err)
 		require.Equal(t, string(data), msg)
 	}
 }
 
+func TestStoreReopen(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_reopen")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	store, err := newStore(f, 0)
+	require.NoError(t, err)
+	testWrite(t, store)
+	require.NoError(t, store.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	store, err = newStore(f, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Equal(t, storeFormatVersion, store.version)
+	testRead(t, store)
+}
+
+func TestStoreChecksumMismatch(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_checksum_mismatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	store, err := newStore(f, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	testWrite(t, store)
+
+	// flip a byte in the payload of the second frame
+	pos := storeHeaderSize + width + lenWidth + crcWidth + attrsWidth
+	_, err = f.WriteAt([]byte{'X'}, int64(pos))
+	require.NoError(t, err)
+
+	_, err = store.Read(storeHeaderSize + width)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = store.Read(storeHeaderSize)
+	require.NoError(t, err)
+}
+
+func TestStoreLegacyFormat(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_legacy_format")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	for i := 0; i < 4; i++ {
+		buf := make([]byte, lenWidth+len(msg))
+		endian.PutUint64(buf, uint64(len(msg)))
+		copy(buf[lenWidth:], msg)
+		_, err := f.Write(buf)
+		require.NoError(t, err)
+	}
+
+	store, err := newStore(f, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	require.Equal(t, storeFormatLegacy, store.version)
+	for i := 0; i < 4; i++ {
+		data, err := store.Read(uint64(lenWidth+len(msg)) * uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, string(data), msg)
+	}
+	_, _, err = store.Write([]byte(msg))
+	require.ErrorIs(t, err, ErrLegacyFormat)
+}
+
+func TestStoreHeader(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_header")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	store, err := newStore(f, 42)
+	require.NoError(t, err)
+	require.Equal(t, featureChecksum, store.features)
+	_, _, err = store.writeBatch([][]byte{[]byte(msg)}, byte(CompressionSnappy)<<attrCompressionShift)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	reopen := func(baseOffset uint64) (*Store, error) {
+		t.Helper()
+		f, err := os.OpenFile(f.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		store, err := openStore(f, baseOffset)
+		if err != nil {
+			require.NoError(t, f.Close())
+		}
+		return store, err
+	}
+	store, err = reopen(42)
+	require.NoError(t, err)
+	require.Equal(t, storeFormatVersion, store.version)
+	require.Equal(t, featureChecksum|featureCompression, store.features)
+	require.NoError(t, store.Close())
+
+	// the store file of another segment.
+	_, err = reopen(0)
+	var formatErr *FormatError
+	require.ErrorAs(t, err, &formatErr)
+	require.Equal(t, uint64(42), formatErr.BaseOffset)
+
+}
+
+func TestStoreHeaderPatched(t *testing.T) {
+	tests := []struct {
+		name    string
+		pos     int64
+		data    []byte
+		wantErr error
+	}{
+		{"newer version", magicWidth, endian.AppendUint32(nil, storeFormatVersion+1), ErrUnknownFormat},
+		{"unknown feature", featuresPos, endian.AppendUint32(nil, featureChecksum|1<<31), ErrUnknownFormat},
+		// a store of storeFormatV2 does not record the base offset nor the features.
+		{"previous version", magicWidth, endian.AppendUint32(nil, storeFormatV2), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "test_store_header")
+			require.NoError(t, err)
+			defer os.RemoveAll(f.Name())
+			store, err := newStore(f, 42)
+			require.NoError(t, err)
+			testWrite(t, store)
+			require.NoError(t, store.Close())
+
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.WriteAt(tt.data, tt.pos)
+			require.NoError(t, err)
+			store, err = openStore(f, 0)
+			require.ErrorIs(t, err, tt.wantErr)
+			if err == nil {
+				require.Equal(t, uint32(0), store.features)
+				testRead(t, store)
+			}
+		})
+	}
+}
+
 func BenchmarkFileStore_Write(b *testing.B) {
 	b.StopTimer()
 	msg := []byte(randStr(1024))
 	f, err := os.CreateTemp("", "test_store_write_and_read")
 	require.NoError(b, err)
 	defer os.RemoveAll(f.Name())
-	store, err := newStore(f)
+	store, err := newStore(f, 0)
 	require.NoError(b, err)
 	//b.ResetTimer()
 	b.StartTimer()
@@ -85,3 +221,85 @@ func BenchmarkFileStore_Write(b *testing.B) {
 		_, _, _ = store.Write(msg)
 	}
 }
+
+func TestStorePreallocate(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_preallocate")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	store, err := newStore(f, 0)
+	require.NoError(t, err)
+	require.NoError(t, store.preallocate(4096))
+	testWrite(t, store)
+	testRead(t, store)
+	require.Equal(t, storeHeaderSize+4*width, store.size.Load())
+
+	size, err := store.Size()
+	require.NoError(t, err)
+	if runtime.GOOS == "linux" {
+		require.Equal(t, uint64(4096), size)
+	}
+
+	require.NoError(t, store.Close())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(storeHeaderSize+4*width), fi.Size(), "close truncates the store to its logical end")
+}
+
+func TestStoreDataEnd(t *testing.T) {
+	f, err := os.CreateTemp("", "test_store_data_end")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+	store, err := newStore(f, 0)
+	require.NoError(t, err)
+	// the last bytes of the data are a multi-byte UTF-8 sequence, which is not decoded.
+	_, pos, err := store.Write([]byte("caf\u00e9"))
+	require.NoError(t, err)
+	end := store.size.Load()
+	_, err = f.WriteAt(make([]byte, 100), int64(end))
+	require.NoError(t, err)
+	store.size.Store(end + 100)
+
+	dataEnd, err := store.dataEnd(pos)
+	require.NoError(t, err)
+	require.Equal(t, end, dataEnd)
+	dataEnd, err = store.dataEnd(end + 10)
+	require.NoError(t, err)
+	require.Equal(t, end+10, dataEnd)
+	require.NoError(t, store.Close())
+}
+
+// BenchmarkFileStore_WriteSync compares the ways to make a write durable.
+func BenchmarkFileStore_WriteSync(b *testing.B) {
+	benchmarks := []struct {
+		name        string
+		sync        func(f *os.File) error
+		preallocate bool
+	}{
+		{name: "fsync", sync: (*os.File).Sync},
+		{name: "fdatasync", sync: fdatasync},
+		{name: "fdatasync-preallocated", sync: fdatasync, preallocate: true},
+	}
+	msg := []byte(randStr(1024))
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			f, err := os.CreateTemp("", "bench_store_write_sync")
+			require.NoError(b, err)
+			defer os.RemoveAll(f.Name())
+			store, err := newStore(f, 0)
+			require.NoError(b, err)
+			defer store.Close()
+			if bm.preallocate {
+				require.NoError(b, store.preallocate(storeHeaderSize+uint64(b.N)*(lenWidth+crcWidth+attrsWidth+uint64(len(msg)))))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := bm.sync(store.File); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
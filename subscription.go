@@ -0,0 +1,76 @@
+package log
+
+import (
+	"context"
+	"errors"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"io"
+)
+
+// Subscription follows a log from an offset and delivers every record once it is appended. Subscriptions of a log
+// are independent of each other.
+type Subscription struct {
+	ctx    context.Context
+	log    *Log
+	reader *Reader
+}
+
+// Subscribe returns a Subscription which delivers the records of the log from offset, including the records
+// appended later. The subscription ends when ctx is done.
+func (l *Log) Subscribe(ctx context.Context, offset uint64) (*Subscription, error) {
+	reader, err := l.NewReader(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{
+		ctx:    ctx,
+		log:    l,
+		reader: reader,
+	}, nil
+}
+
+// Close ends the subscription and releases the segment it is reading. The subscription is closed as well once its
+// context is done.
+func (s *Subscription) Close() error {
+	return s.reader.Close()
+}
+
+// Next returns the next record, and blocks until it is appended if the subscription reached the end of the log. It
+// returns the error of the context once it is done, and ErrLogClosed once the log is closed.
+func (s *Subscription) Next() (*log_v1.Record, error) {
+	for {
+		if err := s.ctx.Err(); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		// The channel is taken before reading, so an append after the end of the log was read is not missed.
+		appended := s.log.waitAppend()
+		record, err := s.reader.Next()
+		if !errors.Is(err, io.EOF) {
+			return record, err
+		}
+		select {
+		case <-appended:
+		case <-s.ctx.Done():
+			_ = s.Close()
+			return nil, s.ctx.Err()
+		case <-s.log.closing:
+			return nil, ErrLogClosed
+		}
+	}
+}
+
+// waitAppend returns a channel which is closed when records are appended.
+func (l *Log) waitAppend() <-chan struct{} {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	return l.appended
+}
+
+// notify wakes up the subscribers waiting for records to be appended.
+func (l *Log) notify() {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	dir, err := os.MkdirTemp("", "subscription-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+
+	const records = 32
+	msgs := make([]string, 0)
+	for i := 0; i < records; i++ {
+		msgs = append(msgs, randStr(42))
+	}
+	for i := 0; i < 4; i++ {
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, from := range []uint64{0, 2, 4} {
+		sub, err := log.Subscribe(ctx, from)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(from uint64) {
+			defer wg.Done()
+			for i := from; i < records; i++ {
+				record, err := sub.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if record.Offset != i || string(record.Value) != msgs[i] {
+					t.Errorf("subscriber from %d got record %d, want %d", from, record.Offset, i)
+					return
+				}
+			}
+		}(from)
+	}
+
+	for i := 4; i < records; i++ {
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	require.Greater(t, len(log.segments), 2)
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "subscription-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := log.Subscribe(ctx, 0)
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := sub.Next()
+		done <- err
+	}()
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	sub, err = log.Subscribe(context.Background(), 0)
+	require.NoError(t, err)
+	go func() {
+		_, err := sub.Next()
+		done <- err
+	}()
+	require.NoError(t, log.Close())
+	require.ErrorIs(t, <-done, ErrLogClosed)
+}
@@ -0,0 +1,77 @@
+package log
+
+import "time"
+
+// commitSegments applies the sync policy to the segments just appended to, then wakes up the subscribers. The caller
+// must hold the lock.
+func (l *Log) commitSegments(segments ...*Segment) error {
+	defer l.notify()
+
+	switch l.Config.Sync.Policy {
+	case SyncAlways:
+		for _, seg := range segments {
+			if err := seg.Sync(); err != nil {
+				return err
+			}
+		}
+		l.unsynced = 0
+	case SyncInterval:
+		if l.Config.Sync.Bytes > 0 && l.unsynced >= l.Config.Sync.Bytes {
+			select {
+			case l.syncs <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// Sync commits the records appended to the log to stable storage. It returns the error of a failed background sync
+// if there is one since the last call.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return err
+	}
+
+	err := l.syncErr
+	l.syncErr = nil
+	if err != nil {
+		return err
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	return nil
+}
+
+// syncLoop syncs the log in the background for SyncInterval until the log is closed.
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+
+	var tick <-chan time.Time
+	if l.Config.Sync.Interval > 0 {
+		ticker := time.NewTicker(l.Config.Sync.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-l.syncs:
+		case <-l.closing:
+			return
+		}
+		l.mu.Lock()
+		if l.unsynced > 0 {
+			if err := l.activeSegment.Sync(); err != nil {
+				l.syncErr = err
+			} else {
+				l.unsynced = 0
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSyncNever(t *testing.T) {
+	dir, err := os.MkdirTemp("", "syncer-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.Sync = SyncConfig{Policy: SyncNever}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := log.Append([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(3), log.unsynced)
+	require.NoError(t, log.Sync())
+	require.Equal(t, uint64(0), log.unsynced)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	for i, msg := range []string{"a", "b", "c"} {
+		b, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(b))
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "syncer-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := defaultConfig
+	config.Sync = SyncConfig{
+		Policy: SyncInterval,
+		Bytes:  16,
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+
+	unsynced := func() uint64 {
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		return log.unsynced
+	}
+
+	_, err = log.Append([]byte("below threshold"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, uint64(15), unsynced())
+
+	_, err = log.Append([]byte("reaches the threshold"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return unsynced() == 0
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, log.Close())
+
+	config.Sync.Interval = time.Millisecond
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	_, err = log.Append([]byte("a"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return unsynced() == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, log.Close())
+}
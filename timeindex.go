@@ -0,0 +1,305 @@
+package log
+
+import (
+	"errors"
+	"github.com/edsrzf/mmap-go"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	timestampWidth = 8
+	timeEntWidth   = timestampWidth + offWidth
+
+	// defaultTimeIndexInterval is the number of bytes appended to a segment between two entries of its time index if
+	// SegmentConfig.TimeIndexInterval is zero.
+	defaultTimeIndexInterval = 4096
+)
+
+// TimeIndex maps the timestamps of the records of a segment to their offsets. It is sparse: an entry is the greatest
+// timestamp of the log up to a record and the relative offset of that record, so every record up to the offset of an
+// entry has a timestamp which is not greater than the one of the entry. The timestamps and the offsets of the entries
+// increase, also across the segments of a log.
+//
+// Like the index file, the time index file has no header and is derived from the store file. The entries are only
+// kept up to the first one out of order, and a missing entry only makes a search read more records.
+type TimeIndex struct {
+	*os.File
+	// size is the size of the entries. It is only changed by the writer of the segment, and loaded by the readers.
+	size atomic.Uint64
+	mmap mmap.MMap
+	// readOnly is set if the time index belongs to a read-only log, it is then read into mmap like Index.
+	readOnly bool
+}
+
+func newTimeIndex(f *os.File, config Config) (*TimeIndex, error) {
+	idx := &TimeIndex{
+		File:     f,
+		readOnly: config.ReadOnly,
+	}
+	// There is at most an entry per record, and the entry written when the segment is sealed.
+	capacity := config.SegmentConfig.MaxIndexSize + timeEntWidth
+	if config.ReadOnly && f == nil {
+		// The segment has no time index file.
+		idx.mmap = make(mmap.MMap, capacity)
+	} else if config.ReadOnly {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		idx.mmap = make(mmap.MMap, max(uint64(fi.Size()), capacity))
+		if _, err := f.ReadAt(idx.mmap[:fi.Size()], 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	} else {
+		if err := os.Truncate(f.Name(), int64(capacity)); err != nil {
+			return nil, err
+		}
+		m, err := mmap.Map(f, mmap.RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		idx.mmap = m
+	}
+	// The file is only truncated to the size of the entries on close, so the size is found from the entries.
+	n := uint64(0)
+	for ; (n+1)*timeEntWidth <= uint64(len(idx.mmap)); n++ {
+		ts, off := idx.entry(n)
+		if n == 0 && ts == 0 && off == 0 {
+			break
+		}
+		if n > 0 {
+			if prevTs, prevOff := idx.entry(n - 1); ts < prevTs || off <= prevOff {
+				break
+			}
+		}
+	}
+	idx.size.Store(n * timeEntWidth)
+	return idx, nil
+}
+
+// entries returns the number of entries.
+func (idx *TimeIndex) entries() uint64 {
+	return idx.size.Load() / timeEntWidth
+}
+
+// entry returns the timestamp and the relative offset of the entry n.
+func (idx *TimeIndex) entry(n uint64) (int64, uint64) {
+	pos := n * timeEntWidth
+	ts := int64(endian.Uint64(idx.mmap[pos : pos+timestampWidth]))
+	off := endian.Uint64(idx.mmap[pos+timestampWidth : pos+timeEntWidth])
+	return ts, off
+}
+
+// last returns the last entry, and whether there is one.
+func (idx *TimeIndex) last() (int64, uint64, bool) {
+	n := idx.entries()
+	if n == 0 {
+		return 0, 0, false
+	}
+	ts, off := idx.entry(n - 1)
+	return ts, off, true
+}
+
+// write appends an entry without flushing the mapped region.
+func (idx *TimeIndex) write(ts int64, off uint64) error {
+	size := idx.size.Load()
+	if uint64(len(idx.mmap)) < size+timeEntWidth {
+		return io.EOF
+	}
+	endian.PutUint64(idx.mmap[size:size+timestampWidth], uint64(ts))
+	endian.PutUint64(idx.mmap[size+timestampWidth:size+timeEntWidth], off)
+	idx.size.Store(size + timeEntWidth)
+	return nil
+}
+
+// search returns the relative offset of the first record which may have a timestamp not lower than ts: the record
+// after the last entry whose timestamp is lower than ts.
+func (idx *TimeIndex) search(ts int64) uint64 {
+	n := sort.Search(int(idx.entries()), func(i int) bool {
+		entryTs, _ := idx.entry(uint64(i))
+		return entryTs >= ts
+	})
+	if n == 0 {
+		return 0
+	}
+	_, off := idx.entry(uint64(n - 1))
+	return off + 1
+}
+
+// truncate discards the entries of the records from the relative offset n, and zeroes them like Index.truncate.
+func (idx *TimeIndex) truncate(n uint64) {
+	keep := sort.Search(int(idx.entries()), func(i int) bool {
+		_, off := idx.entry(uint64(i))
+		return off >= n
+	})
+	end := idx.size.Load()
+	for i := uint64(keep) * timeEntWidth; i < end; i++ {
+		idx.mmap[i] = 0
+	}
+	idx.size.Store(uint64(keep) * timeEntWidth)
+}
+
+// Sync flushes the mapped region to the time index file.
+func (idx *TimeIndex) Sync() error {
+	if idx.readOnly {
+		return nil
+	}
+	return idx.mmap.Flush()
+}
+
+func (idx *TimeIndex) Close() error {
+	if idx.readOnly {
+		if idx.File == nil {
+			return nil
+		}
+		return idx.File.Close()
+	}
+	if err := idx.mmap.Flush(); err != nil {
+		return err
+	}
+	if err := idx.mmap.Unmap(); err != nil {
+		return err
+	}
+	if err := idx.File.Truncate(int64(idx.size.Load())); err != nil {
+		return err
+	}
+	return idx.File.Close()
+}
+
+// OffsetForTime returns the offset of the first record whose timestamp is at or after t, or ErrNoRecordAfterTime if
+// there is none. The timestamps of the records are the times they were appended unless they were set by the caller of
+// AppendRecord, so they may not increase with the offsets: the first record is the one with the lowest offset.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	if err := l.failure(); err != nil {
+		return 0, err
+	}
+	ts := t.UnixNano()
+	segments := l.segmentsView()
+	// The greatest timestamps of the log up to the segments increase, so the first segment with a record at or after
+	// t is found by binary search.
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].maxTimestamp.Load() >= ts
+	})
+	for ; i < len(segments); i++ {
+		seg := segments[i]
+		if !seg.tryAcquire() {
+			continue
+		}
+		offset, ok, err := seg.offsetForTime(ts)
+		_ = seg.release()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+	return 0, ErrNoRecordAfterTime
+}
+
+// offsetForTime returns the offset of the first record of the segment whose timestamp is not lower than ts, and
+// whether there is one. The records are read from the one found by the time index.
+func (s *Segment) offsetForTime(ts int64) (uint64, bool, error) {
+	s.readMu.RLock()
+	defer s.readMu.RUnlock()
+
+	next := s.nextOffset.Load()
+	for offset := s.baseOffset + s.timeIndex.search(ts); offset < next; offset++ {
+		record, err := s.record(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// record decodes the record of offset. The caller must hold the read lock, or the lock of the writers.
+func (s *Segment) record(offset uint64) (*log_v1.Record, error) {
+	data, err := s.payload(offset)
+	if err != nil {
+		return nil, err
+	}
+	record := new(log_v1.Record)
+	if err := s.codec.Decode(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// indexTime takes the timestamps of the appended records, which were written with n bytes, into account. An entry is
+// written to the time index once SegmentConfig.TimeIndexInterval bytes were appended since the last one, if the
+// greatest timestamp increased. The caller must hold the lock.
+func (s *Segment) indexTime(records []*log_v1.Record, n uint64) error {
+	maxTimestamp := s.maxTimestamp.Load()
+	for _, record := range records {
+		if record.Timestamp > maxTimestamp {
+			maxTimestamp = record.Timestamp
+		}
+	}
+	s.maxTimestamp.Store(maxTimestamp)
+
+	s.unindexed += n
+	if s.unindexed < s.config.timeIndexInterval() {
+		return nil
+	}
+	if ts, _, ok := s.timeIndex.last(); ok && ts >= maxTimestamp {
+		return nil
+	}
+	s.unindexed = 0
+	return s.timeIndex.write(maxTimestamp, records[len(records)-1].Offset-s.baseOffset)
+}
+
+// sealTimeIndex writes the entry of the last record of the segment to the time index, so the greatest timestamp of the
+// segment is known without reading its records once it is reopened. The caller must hold the lock.
+func (s *Segment) sealTimeIndex() error {
+	next := s.nextOffset.Load()
+	if next == s.baseOffset {
+		return nil
+	}
+	if _, off, ok := s.timeIndex.last(); ok && off == next-1-s.baseOffset {
+		return nil
+	}
+	return s.timeIndex.write(s.maxTimestamp.Load(), next-1-s.baseOffset)
+}
+
+// loadTimestamps finds the greatest timestamp of the log up to the last record of the segment, given prev the one of
+// the previous segments. The entries of the time index beyond the last record are discarded, and the records after the
+// last entry are read. A corrupt record is skipped. The caller must hold both locks of the segment, or use a segment
+// which is not shared yet.
+func (s *Segment) loadTimestamps(prev int64) error {
+	s.prevTimestamp = prev
+	next := s.nextOffset.Load()
+	s.timeIndex.truncate(next - s.baseOffset)
+
+	maxTimestamp := prev
+	offset := s.baseOffset
+	if ts, off, ok := s.timeIndex.last(); ok {
+		if ts > maxTimestamp {
+			maxTimestamp = ts
+		}
+		offset = s.baseOffset + off + 1
+	}
+	for ; offset < next; offset++ {
+		record, err := s.record(offset)
+		if errors.Is(err, ErrCorruptRecord) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.Timestamp > maxTimestamp {
+			maxTimestamp = record.Timestamp
+		}
+	}
+	s.maxTimestamp.Store(maxTimestamp)
+	s.unindexed = 0
+	return s.timeIndex.Sync()
+}
@@ -0,0 +1,145 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp("", "test_time_index")
+	require.NoError(t, err)
+	defer os.RemoveAll(f.Name())
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxIndexSize: 1024,
+		},
+	}
+	idx, err := newTimeIndex(f, config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx.entries())
+	require.Equal(t, uint64(0), idx.search(100))
+
+	for i, ts := range []int64{100, 200, 200, 400} {
+		require.NoError(t, idx.write(ts, uint64(i*2+1)))
+	}
+	require.Equal(t, uint64(0), idx.search(100))
+	require.Equal(t, uint64(2), idx.search(101))
+	require.Equal(t, uint64(2), idx.search(200))
+	require.Equal(t, uint64(6), idx.search(201))
+	require.Equal(t, uint64(8), idx.search(401))
+	require.NoError(t, idx.Sync())
+
+	// the size is found from the entries when the file was not truncated to it by a crash.
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	reopened, err := newTimeIndex(f, config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), reopened.entries())
+	require.NoError(t, reopened.Close())
+
+	idx.truncate(5)
+	require.Equal(t, uint64(2), idx.entries())
+	ts, off, ok := idx.last()
+	require.True(t, ok)
+	require.Equal(t, int64(200), ts)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, idx.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f, config)
+	require.NoError(t, err)
+	defer idx.Close()
+	require.Equal(t, uint64(2), idx.entries())
+}
+
+func TestOffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "time-index-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize:    128,
+			MaxIndexSize:      1024,
+			TimeIndexInterval: 64,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	// the timestamps do not always increase with the offsets.
+	timestamps := []int64{1000, 2000, 1500, 3000, 4000, 3500, 5000, 6000, 7000, 6500, 8000, 9000}
+	for _, ts := range timestamps {
+		_, err := log.AppendRecord(&log_v1.Record{Value: []byte(randStr(20)), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	_, err = os.Stat(log.activeSegment.TimeIndexFileName())
+	require.NoError(t, err)
+
+	tests := []struct {
+		ts     int64
+		offset uint64
+	}{
+		{ts: 0, offset: 0},
+		{ts: 1000, offset: 0},
+		{ts: 1001, offset: 1},
+		{ts: 1500, offset: 1},
+		{ts: 2001, offset: 3},
+		{ts: 3200, offset: 4},
+		{ts: 6200, offset: 8},
+		{ts: 6600, offset: 8},
+		{ts: 7001, offset: 10},
+		{ts: 9000, offset: 11},
+	}
+	check := func(log *Log) {
+		for _, tt := range tests {
+			offset, err := log.OffsetForTime(time.Unix(0, tt.ts))
+			require.NoError(t, err)
+			require.Equal(t, tt.offset, offset, "timestamp %d", tt.ts)
+		}
+		_, err := log.OffsetForTime(time.Unix(0, 9001))
+		require.ErrorIs(t, err, ErrNoRecordAfterTime)
+	}
+	check(log)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	check(log)
+	for _, seg := range log.segments[:len(log.segments)-1] {
+		_, off, ok := seg.timeIndex.last()
+		require.True(t, ok)
+		require.Equal(t, seg.nextOffset.Load()-1-seg.baseOffset, off)
+	}
+
+	// the records after the truncation are no longer found.
+	require.NoError(t, log.Truncate(8))
+	_, err = log.OffsetForTime(time.Unix(0, 7001))
+	require.ErrorIs(t, err, ErrNoRecordAfterTime)
+	_, err = log.OffsetForTime(time.Unix(0, 6200))
+	require.ErrorIs(t, err, ErrNoRecordAfterTime)
+	offset, err := log.OffsetForTime(time.Unix(0, 5500))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), offset)
+	_, err = log.AppendRecord(&log_v1.Record{Value: []byte("late"), Timestamp: 10000})
+	require.NoError(t, err)
+	offset, err = log.OffsetForTime(time.Unix(0, 6200))
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), offset)
+}
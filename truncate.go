@@ -0,0 +1,297 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+)
+
+const (
+	// truncateMarkerName is the name of the file which records a truncation of the log until it is complete. A
+	// truncation interrupted by a crash is completed when the log is reopened.
+	truncateMarkerName = "TRUNCATE"
+
+	truncateMarkerSize = offWidth + crcWidth
+)
+
+// Truncate removes the records from offset to the end of the log. The segments after the one containing offset are
+// deleted, the store and the index files of that segment are cut after the record before offset, and it becomes the
+// active segment again, so the next record appended gets offset. Truncating at the offset of the next record to be
+// appended does nothing.
+//
+// Truncate is crash safe: the offset is recorded in a marker file before the log is changed, and a truncation
+// interrupted by a crash is completed when the log is reopened. If offset is in the middle of a compressed frame, the
+// frame is replaced by a frame of the records before offset, which is recorded in the marker file as well. Readers and
+// subscriptions which read records at or after offset must be recreated. If Truncate fails once the marker is written,
+// the log is failed like by Reset, as the marker would truncate the records appended later when the log is reopened.
+func (l *Log) Truncate(offset uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.failure(); err != nil {
+		return err
+	}
+
+	if offset < l.segments[0].baseOffset || offset > l.activeSegment.nextOffset.Load() {
+		return ErrIllegalOffsetRange
+	}
+	if offset == l.activeSegment.nextOffset.Load() {
+		return nil
+	}
+	rewrite, err := l.truncateFrame(offset)
+	if err != nil {
+		return err
+	}
+	if err := writeTruncateMarker(l.Dir, offset, rewrite); err != nil {
+		// The log is not changed yet, but a marker written in full would still truncate it when it is reopened.
+		if err := removeTruncateMarker(l.Dir); err != nil {
+			return l.fail("truncate", err)
+		}
+		return err
+	}
+	if err := l.truncate(offset, rewrite); err != nil {
+		return l.fail("truncate", err)
+	}
+	if err := removeTruncateMarker(l.Dir); err != nil {
+		return l.fail("truncate", err)
+	}
+	return nil
+}
+
+// resumeTruncate completes the truncation recorded by the marker file, if the log was closed in the middle of it.
+func (l *Log) resumeTruncate() error {
+	offset, rewrite, ok, err := readTruncateMarker(l.Dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	// The records of the replaced frame are dropped by the recovery if the crash happened before the frame replacing
+	// it was written.
+	end := offset
+	if rewrite != nil {
+		end = endian.Uint64(rewrite[attrsWidth:])
+	}
+	if offset >= l.segments[0].baseOffset && end <= l.activeSegment.nextOffset.Load() {
+		if err := l.truncate(offset, rewrite); err != nil {
+			return err
+		}
+	}
+	return removeTruncateMarker(l.Dir)
+}
+
+// truncateFrame returns the frame which replaces the compressed frame containing offset: its attributes, the offset of
+// its first record and its payload, encrypted like the frame it replaces. It returns nil if offset is not in the
+// middle of a compressed frame. The caller must hold the lock.
+func (l *Log) truncateFrame(offset uint64) ([]byte, error) {
+	seg := l.segments[l.searchSegment(offset)]
+	if offset == seg.baseOffset || offset >= seg.nextOffset.Load() {
+		return nil, nil
+	}
+	_, pos, err := seg.index.Read(offset - seg.baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	f, err := seg.store.readFrame(pos)
+	if err != nil {
+		return nil, err
+	}
+	c := f.compression()
+	if c == CompressionNone {
+		return nil, nil
+	}
+	first, records, err := c.decodeBatch(f.data)
+	if err != nil {
+		return nil, err
+	}
+	if first >= offset {
+		return nil, nil
+	}
+	data, err := c.encodeBatch(first, records[:offset-first])
+	if err != nil {
+		return nil, err
+	}
+	if data, err = seg.store.encrypt(pos, data); err != nil {
+		return nil, err
+	}
+	rewrite := append([]byte{f.attrs &^ attrBatchContinue}, endian.AppendUint64(nil, first)...)
+	return append(rewrite, data...), nil
+}
+
+// truncate removes the records from offset to the end of the log. rewrite is the frame which replaces the compressed
+// frame containing offset, if any. It can be repeated after a crash, every step leaves the log in a state from which
+// it completes. The caller must hold the lock.
+func (l *Log) truncate(offset uint64, rewrite []byte) error {
+	defer l.publish()
+
+	// The segments from the one starting at offset are removed, but the first segment is kept even if it is truncated
+	// to no record at all. They are dropped from the manifest before their files are removed.
+	keep := l.searchSegment(offset) + 1
+	if keep > 1 && l.segments[keep-1].baseOffset == offset {
+		keep--
+	}
+	if keep < len(l.segments) {
+		if err := l.commitManifest(l.segments[:keep]); err != nil {
+			return err
+		}
+	}
+	for n := len(l.segments); n > keep; n-- {
+		if err := l.segments[n-1].remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:n-1]
+	}
+	seg := l.segments[keep-1]
+	l.activeSegment = seg
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+
+	seg.mu.Lock()
+	seg.readMu.Lock()
+	err := seg.truncate(offset, rewrite)
+	seg.readMu.Unlock()
+	seg.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.ensureAppendable()
+}
+
+// truncate discards the records of the segment from offset and their time index entries, and preallocates the store
+// file again as the segment becomes the active one. The record before offset is made the end of its batch before the
+// store file is cut, so a crash in between leaves complete batches. The caller must hold both locks of the segment.
+func (s *Segment) truncate(offset uint64, rewrite []byte) error {
+	if err := s.store.unmapFile(); err != nil {
+		return err
+	}
+	if rewrite != nil {
+		if err := s.rewriteFrame(offset, rewrite); err != nil {
+			return err
+		}
+	} else if offset < s.nextOffset.Load() {
+		n := offset - s.baseOffset
+		end := s.store.headerSize()
+		if n > 0 {
+			_, pos, err := s.index.Read(n - 1)
+			if err != nil {
+				return err
+			}
+			if end, err = s.store.endBatch(pos); err != nil {
+				return err
+			}
+		}
+		if err := s.store.truncate(end); err != nil {
+			return err
+		}
+		if err := s.store.Sync(); err != nil {
+			return err
+		}
+		s.index.truncate(n)
+		if err := s.index.Sync(); err != nil {
+			return err
+		}
+		s.nextOffset.Store(offset)
+	}
+	if err := s.loadTimestamps(s.prevTimestamp); err != nil {
+		return err
+	}
+	return s.preallocate()
+}
+
+// rewriteFrame replaces the compressed frame containing offset by rewrite, which carries the records of the frame
+// before offset, and discards everything after it. The frame is written again if the truncation is resumed after a
+// crash, and appended if the recovery already dropped it. The caller must hold both locks of the segment.
+func (s *Segment) rewriteFrame(offset uint64, rewrite []byte) error {
+	attrs, first, data := rewrite[0], endian.Uint64(rewrite[attrsWidth:]), rewrite[attrsWidth+offWidth:]
+	if first < s.baseOffset || first >= offset || first > s.nextOffset.Load() {
+		return ErrCorruptRecord
+	}
+	pos := s.store.logicalSize()
+	if first < s.nextOffset.Load() {
+		var err error
+		if _, pos, err = s.index.Read(first - s.baseOffset); err != nil {
+			return err
+		}
+	}
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	// The payload is encrypted for pos already.
+	if _, _, err := s.store.writeFrames([][]byte{data}, []byte{attrs}, false); err != nil {
+		return err
+	}
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	s.index.truncate(first - s.baseOffset)
+	for off := first; off < offset; off++ {
+		if err := s.index.write(off-s.baseOffset, pos); err != nil {
+			return err
+		}
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	s.nextOffset.Store(offset)
+	return nil
+}
+
+// writeTruncateMarker records that the log is truncated at offset, and the frame rewrite if it replaces a compressed
+// frame. The marker carries a checksum, so a marker torn by a crash is ignored: the log was not changed yet.
+func writeTruncateMarker(dir string, offset uint64, rewrite []byte) error {
+	buf := make([]byte, truncateMarkerSize, truncateMarkerSize+len(rewrite))
+	endian.PutUint64(buf[:offWidth], offset)
+	buf = append(buf, rewrite...)
+	endian.PutUint32(buf[offWidth:truncateMarkerSize], checksum(buf[:offWidth], buf[truncateMarkerSize:]))
+
+	f, err := os.OpenFile(path.Join(dir, truncateMarkerName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readTruncateMarker returns the offset and the frame recorded by the marker file, and whether there is a valid one.
+func readTruncateMarker(dir string) (uint64, []byte, bool, error) {
+	buf, err := os.ReadFile(path.Join(dir, truncateMarkerName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	// A frame recorded after the offset holds more than its attributes and the offset of its first record.
+	torn := len(buf) < truncateMarkerSize ||
+		len(buf) > truncateMarkerSize && len(buf) <= truncateMarkerSize+attrsWidth+offWidth
+	if torn || endian.Uint32(buf[offWidth:truncateMarkerSize]) != checksum(buf[:offWidth], buf[truncateMarkerSize:]) {
+		return 0, nil, false, removeTruncateMarker(dir)
+	}
+	var rewrite []byte
+	if len(buf) > truncateMarkerSize {
+		rewrite = buf[truncateMarkerSize:]
+	}
+	return endian.Uint64(buf[:offWidth]), rewrite, true, nil
+}
+
+// removeTruncateMarker removes the marker file once the truncation is complete.
+func removeTruncateMarker(dir string) error {
+	if err := os.Remove(path.Join(dir, truncateMarkerName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(dir)
+}
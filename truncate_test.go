@@ -0,0 +1,346 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTruncateLog(t *testing.T, dir string) *Log {
+	t.Helper()
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	return log
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   uint64
+		segments int
+	}{
+		{name: "middle of a segment", offset: 5, segments: 3},
+		{name: "start of a segment", offset: 6, segments: 3},
+		{name: "whole log", offset: 0, segments: 1},
+		{name: "last record", offset: 15, segments: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "truncate-test")
+			require.NoError(t, err)
+			defer func(path string) {
+				err := os.RemoveAll(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(dir)
+
+			log := newTruncateLog(t, dir)
+			msgs := make([]string, 0, 16)
+			for i := 0; i < 16; i++ {
+				msgs = append(msgs, randStr(42))
+				_, err := log.Append([]byte(msgs[i]))
+				require.NoError(t, err)
+			}
+			removed := log.segments[tt.segments:]
+
+			require.NoError(t, log.Truncate(tt.offset))
+			require.Equal(t, tt.segments, len(log.segments))
+			require.Equal(t, log.segments[tt.segments-1], log.activeSegment)
+			require.Equal(t, tt.offset, log.activeSegment.nextOffset.Load())
+			for _, seg := range removed {
+				_, err := os.Stat(seg.StoreFileName())
+				require.ErrorIs(t, err, os.ErrNotExist)
+			}
+			_, err = os.Stat(path.Join(dir, truncateMarkerName))
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			_, err = log.Read(tt.offset)
+			require.ErrorIs(t, err, ErrIllegalOffsetRange)
+			offset, err := log.Append([]byte("appended"))
+			require.NoError(t, err)
+			require.Equal(t, tt.offset, offset)
+			require.NoError(t, log.Close())
+
+			log = newTruncateLog(t, dir)
+			defer func(log *Log) {
+				err := log.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(log)
+			require.Empty(t, log.RecoveryReports())
+			for i := uint64(0); i < tt.offset; i++ {
+				data, err := log.Read(i)
+				require.NoError(t, err)
+				require.Equal(t, msgs[i], string(data))
+			}
+			data, err := log.Read(tt.offset)
+			require.NoError(t, err)
+			require.Equal(t, "appended", string(data))
+			require.Equal(t, tt.offset+1, log.activeSegment.nextOffset.Load())
+		})
+	}
+}
+
+func TestTruncateIllegalOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log := newTruncateLog(t, dir)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	for i := 0; i < 8; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact(4))
+
+	require.ErrorIs(t, log.Truncate(9), ErrIllegalOffsetRange)
+	require.ErrorIs(t, log.Truncate(3), ErrIllegalOffsetRange)
+	require.NoError(t, log.Truncate(8))
+	require.Equal(t, uint64(8), log.activeSegment.nextOffset.Load())
+	require.NoError(t, log.Truncate(4))
+	require.Equal(t, 1, len(log.segments))
+	require.Equal(t, uint64(4), log.activeSegment.nextOffset.Load())
+}
+
+func TestTruncateBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	_, _, err = log.AppendBatch([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+	require.NoError(t, err)
+
+	// the record before the truncation point is in the middle of the batch, it must not be dropped as the frame of an
+	// incomplete batch by the recovery.
+	require.NoError(t, log.Truncate(2))
+	crash(t, log)
+
+	log, err = NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Empty(t, log.RecoveryReports())
+	require.Equal(t, uint64(2), log.activeSegment.nextOffset.Load())
+	for i, msg := range []string{"a", "b"} {
+		data, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, msg, string(data))
+	}
+}
+
+func TestResumeTruncate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log := newTruncateLog(t, dir)
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+
+	// the process died after recording the truncation, dropping the later segments from the manifest and removing
+	// some of them.
+	require.NoError(t, writeTruncateMarker(dir, 5, nil))
+	require.NoError(t, log.commitManifest(log.segments[:3]))
+	for _, seg := range log.segments[5:] {
+		require.NoError(t, os.Remove(seg.IndexFileName()))
+		require.NoError(t, os.Remove(seg.StoreFileName()))
+	}
+	left := []string{log.segments[3].StoreFileName(), log.segments[4].IndexFileName()}
+	crash(t, log)
+
+	log = newTruncateLog(t, dir)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	require.Equal(t, 3, len(log.segments))
+	require.Equal(t, uint64(5), log.activeSegment.nextOffset.Load())
+	for _, name := range left {
+		_, err = os.Stat(name)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	_, err = log.Read(4)
+	require.NoError(t, err)
+	_, err = log.Read(5)
+	require.ErrorIs(t, err, ErrIllegalOffsetRange)
+	_, err = os.Stat(path.Join(dir, truncateMarkerName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// a marker torn by a crash is ignored, the log was not changed yet.
+	require.NoError(t, os.WriteFile(path.Join(dir, truncateMarkerName), []byte{0, 0, 0}, 0644))
+	offset, rewrite, ok, err := readTruncateMarker(dir)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Zero(t, offset)
+	require.Nil(t, rewrite)
+	_, err = os.Stat(path.Join(dir, truncateMarkerName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTruncateFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log := newTruncateLog(t, dir)
+	for i := 0; i < 16; i++ {
+		_, err := log.Append([]byte(randStr(42)))
+		require.NoError(t, err)
+	}
+
+	// the manifest dropping the later segments can not be written once the truncation is recorded.
+	require.NoError(t, os.Mkdir(path.Join(dir, manifestTempFileName), 0755))
+	require.ErrorIs(t, log.Truncate(1), ErrLogFailed)
+	_, err = os.Stat(path.Join(dir, truncateMarkerName))
+	require.NoError(t, err)
+
+	// no record is appended which the truncation would drop when the log is reopened.
+	_, err = log.Append([]byte("a"))
+	require.ErrorIs(t, err, ErrLogFailed)
+	require.ErrorIs(t, log.Truncate(1), ErrLogFailed)
+	require.NoError(t, log.Close())
+
+	log = newTruncateLog(t, dir)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	offset, err := log.Append([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	_, err = os.Stat(path.Join(dir, truncateMarkerName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTruncateCompressedBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the log as if the process died in the middle of the truncation at offset 6.
+		crash func(t *testing.T, log *Log)
+	}{
+		{name: "complete"},
+		{name: "store cut", crash: func(t *testing.T, log *Log) {
+			rewrite, err := log.truncateFrame(6)
+			require.NoError(t, err)
+			require.NotNil(t, rewrite)
+			require.NoError(t, writeTruncateMarker(log.Dir, 6, rewrite))
+			_, pos, err := log.activeSegment.index.Read(4)
+			require.NoError(t, err)
+			require.NoError(t, log.activeSegment.store.truncate(pos))
+		}},
+		{name: "frame rewritten", crash: func(t *testing.T, log *Log) {
+			rewrite, err := log.truncateFrame(6)
+			require.NoError(t, err)
+			require.NoError(t, writeTruncateMarker(log.Dir, 6, rewrite))
+			_, pos, err := log.activeSegment.index.Read(4)
+			require.NoError(t, err)
+			require.NoError(t, log.activeSegment.store.truncate(pos))
+			_, _, err = log.activeSegment.store.writeFrames([][]byte{rewrite[attrsWidth+offWidth:]}, rewrite[:attrsWidth], false)
+			require.NoError(t, err)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "truncate-test")
+			require.NoError(t, err)
+			defer func(path string) {
+				err := os.RemoveAll(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(dir)
+
+			config := Config{SegmentConfig: defaultConfig.SegmentConfig, Compression: CompressionZstd}
+			log, err := NewLog(dir, config)
+			require.NoError(t, err)
+			for i := 0; i < 12; i += 4 {
+				_, _, err := log.AppendBatch([][]byte{jsonRecord(i), jsonRecord(i + 1), jsonRecord(i + 2), jsonRecord(i + 3)})
+				require.NoError(t, err)
+			}
+
+			if tt.crash == nil {
+				require.NoError(t, log.Truncate(6))
+				require.Equal(t, uint64(6), log.activeSegment.nextOffset.Load())
+				_, err = log.Read(6)
+				require.ErrorIs(t, err, ErrIllegalOffsetRange)
+				require.NoError(t, log.Close())
+			} else {
+				tt.crash(t, log)
+				crash(t, log)
+			}
+
+			log, err = NewLog(dir, config)
+			require.NoError(t, err)
+			defer func(log *Log) {
+				err := log.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}(log)
+			_, err = os.Stat(path.Join(dir, truncateMarkerName))
+			require.ErrorIs(t, err, os.ErrNotExist)
+			require.Equal(t, uint64(6), log.activeSegment.nextOffset.Load())
+			offset, err := log.Append([]byte("appended"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(6), offset)
+			for i := 0; i < 6; i++ {
+				data, err := log.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, string(jsonRecord(i)), string(data))
+			}
+			report, err := log.RepairSegment(0)
+			require.NoError(t, err)
+			require.False(t, report.Repaired())
+		})
+	}
+}
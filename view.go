@@ -0,0 +1,96 @@
+package log
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// recordValueField is the field number of Record.Value, and recordOffsetField the one of Record.Offset.
+	recordValueField  protowire.Number = 1
+	recordOffsetField protowire.Number = 2
+)
+
+// View calls fn with the value of the record of offset. The segments which are no longer appended to are mapped to
+// memory, and the value of their records is a slice into the mapping rather than a copy. The value is only valid
+// until fn returns and must not be modified: fn copies it if it is needed afterwards. The segment is not closed,
+// truncated or deleted while fn runs, so fn must not wait for Truncate, Compact or Close.
+func (l *Log) View(offset uint64, fn func(value []byte) error) error {
+	seg := l.acquireSegment(offset)
+	if seg == nil {
+		return ErrIllegalOffsetRange
+	}
+	defer seg.release()
+	return seg.view(offset, fn)
+}
+
+// view calls fn with the value of the record of offset without copying it out of the mapping of a sealed store.
+func (s *Segment) view(offset uint64, fn func(value []byte) error) error {
+	s.readMu.RLock()
+	defer s.readMu.RUnlock()
+
+	data, err := s.payload(offset)
+	if err != nil {
+		return err
+	}
+	value, err := s.codec.Value(data)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// recordValue returns the value of the record data encoded by ProtoCodec without decoding the whole record, so it is
+// not copied.
+func recordValue(data []byte) ([]byte, error) {
+	var value []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == recordValueField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			value = v
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return value, nil
+}
+
+// recordOffset returns the offset of the record data encoded by ProtoCodec without decoding the whole record. It is
+// zero if the field is missing, as proto3 does not encode a zero offset.
+func recordOffset(data []byte) (uint64, error) {
+	var offset uint64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0, ErrCorruptRecord
+		}
+		data = data[n:]
+		if num == recordOffsetField && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return 0, ErrCorruptRecord
+			}
+			offset = v
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return 0, ErrCorruptRecord
+		}
+		data = data[n:]
+	}
+	return offset, nil
+}
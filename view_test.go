@@ -0,0 +1,204 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	log_v1 "github.com/yongsheng1992/yawal/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"testing"
+)
+
+func TestView(t *testing.T) {
+	dir, err := os.MkdirTemp("", "view-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 128,
+			MaxIndexSize:   1024,
+		},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(t, err)
+	msgs := make([]string, 0, 8)
+	for i := 0; i < 7; i++ {
+		msgs = append(msgs, randStr(42))
+		_, err := log.Append([]byte(msgs[i]))
+		require.NoError(t, err)
+	}
+
+	view := func(t *testing.T, log *Log) {
+		t.Helper()
+		for i, msg := range msgs {
+			err := log.View(uint64(i), func(value []byte) error {
+				require.Equal(t, msg, string(value))
+				return nil
+			})
+			require.NoError(t, err)
+		}
+		require.ErrorIs(t, log.View(uint64(len(msgs)), func(value []byte) error {
+			return nil
+		}), ErrIllegalOffsetRange)
+	}
+
+	// the sealed segments are mapped to memory, the active one is not
+	for _, seg := range log.segments[:3] {
+		require.NotNil(t, seg.store.mapping.Load())
+	}
+	require.Nil(t, log.activeSegment.store.mapping.Load())
+	view(t, log)
+
+	// the sealed segments are mapped again when the log is reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, config)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	for _, seg := range log.segments[:3] {
+		require.NotNil(t, seg.store.mapping.Load())
+	}
+	view(t, log)
+
+	// a sealed segment which becomes active again is no longer mapped
+	require.NoError(t, log.Truncate(5))
+	msgs = msgs[:5]
+	require.Nil(t, log.activeSegment.store.mapping.Load())
+	msgs = append(msgs, randStr(42))
+	_, err = log.Append([]byte(msgs[5]))
+	require.NoError(t, err)
+	view(t, log)
+}
+
+func TestViewCorruptRecord(t *testing.T) {
+	dir, err := os.MkdirTemp("", "view-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(dir)
+
+	log, err := NewLog(dir, defaultConfig)
+	require.NoError(t, err)
+	defer func(log *Log) {
+		err := log.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(log)
+	_, err = log.Append([]byte("A"))
+	require.NoError(t, err)
+	require.NoError(t, log.newSegment(1))
+
+	// the mapping is shared with the file, so the corruption shows through it
+	seg := log.segments[0]
+	_, pos, err := seg.index.Read(0)
+	require.NoError(t, err)
+	f, err := os.OpenFile(seg.StoreFileName(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos+lenWidth+crcWidth+attrsWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = log.View(0, func(value []byte) error {
+		t.Fatal("corrupt record must not be viewed")
+		return nil
+	})
+	var corrupt *CorruptRecordError
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, CorruptRecordError{BaseOffset: 0, Offset: 0, Pos: pos}, *corrupt)
+}
+
+func TestRecordValue(t *testing.T) {
+	data, err := proto.Marshal(&log_v1.Record{Value: []byte("value"), Offset: 42})
+	require.NoError(t, err)
+	value, err := recordValue(data)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value))
+	// the value is a slice of data
+	require.Equal(t, &data[2], &value[0])
+
+	// the fields which are unknown to this version of Record are skipped
+	data = protowire.AppendTag(data, 15, protowire.BytesType)
+	data = protowire.AppendBytes(data, []byte("unknown"))
+	value, err = recordValue(data)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value))
+
+	_, err = recordValue(data[:len(data)-1])
+	require.Error(t, err)
+}
+
+// BenchmarkLog_ReadSealed compares the allocations of reading the records of sealed segments with ReadAt and
+// decoding them, as Read did before the sealed segments were mapped, with reading them through the mapping.
+func BenchmarkLog_ReadSealed(b *testing.B) {
+	dir, err := os.MkdirTemp("", "view-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		SegmentConfig: SegmentConfig{
+			MaxSegmentSize: 1 << 20,
+			MaxIndexSize:   1 << 20,
+		},
+		Sync: SyncConfig{Policy: SyncNever},
+	}
+	log, err := NewLog(dir, config)
+	require.NoError(b, err)
+	defer log.Close()
+	for i := 0; i < 5000; i++ {
+		_, err := log.Append([]byte(randStr(100)))
+		require.NoError(b, err)
+	}
+	require.NoError(b, log.newSegment(5000))
+	seg := log.segments[0]
+	records := seg.nextOffset.Load()
+
+	b.Run("ReadAt", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, pos, err := seg.index.Read(uint64(n) % records)
+			if err != nil {
+				b.Fatal(err)
+			}
+			f, err := seg.store.readFrame(pos)
+			if err != nil {
+				b.Fatal(err)
+			}
+			record := new(log_v1.Record)
+			if err := proto.Unmarshal(f.data, record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := log.Read(uint64(n) % records); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("View", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if err := log.View(uint64(n)%records, func(value []byte) error {
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}